@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"tounetcore/internal/auth"
+	"tounetcore/internal/config"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("Usage: go run cmd/keys/main.go <command>")
+		fmt.Println("Commands:")
+		fmt.Println("  list          - List JWT signing keys")
+		fmt.Println("  rotate [keep] - Generate a new signing key and keep the newest [keep] keys (default 3)")
+		os.Exit(1)
+	}
+
+	command := os.Args[1]
+
+	// Load configuration
+	cfg := config.LoadConfig()
+	if cfg.JWTAlgorithm == auth.AlgHS256 {
+		log.Fatal("JWT_ALGORITHM is HS256, set it to RS256, ES256 or EdDSA to use signing keys")
+	}
+	if err := os.MkdirAll(cfg.JWTKeysDir, 0700); err != nil {
+		log.Fatal("Failed to create keys directory:", err)
+	}
+
+	switch command {
+	case "list":
+		keys, err := auth.LoadKeySet(cfg)
+		if err != nil {
+			log.Fatal("Failed to load keys:", err)
+		}
+		for _, jwk := range keys.JWKS()["keys"].([]map[string]interface{}) {
+			fmt.Printf("🔑 %s (%s)\n", jwk["kid"], jwk["alg"])
+		}
+
+	case "rotate":
+		keep := 3
+		if len(os.Args) > 2 {
+			n, err := strconv.Atoi(os.Args[2])
+			if err != nil || n < 2 {
+				log.Fatal("keep must be a number of at least 2 so tokens signed by the previous key still verify")
+			}
+			keep = n
+		}
+
+		kid, err := auth.GenerateKeyFile(cfg.JWTKeysDir, cfg.JWTAlgorithm)
+		if err != nil {
+			log.Fatal("Failed to generate key:", err)
+		}
+		fmt.Printf("✅ New %s signing key %s is now active\n", cfg.JWTAlgorithm, kid)
+
+		removed, err := auth.PruneKeyFiles(cfg.JWTKeysDir, keep)
+		if err != nil {
+			log.Fatal("Failed to prune old keys:", err)
+		}
+		for _, old := range removed {
+			fmt.Printf("🗑  Removed old key %s\n", old)
+		}
+		fmt.Printf("   Running servers pick up the new key within JWT_KEYS_RELOAD_INTERVAL (%s)\n", cfg.JWTKeysReloadInterval)
+
+	default:
+		fmt.Printf("Unknown command: %s\n", command)
+		os.Exit(1)
+	}
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"tounetcore/internal/api"
+	"tounetcore/internal/auth"
 	"tounetcore/internal/config"
 	"tounetcore/internal/database"
+	"tounetcore/internal/middleware"
+	"tounetcore/internal/notify"
 
 	"github.com/gin-gonic/gin"
 )
@@ -26,16 +35,30 @@ func main() {
 		log.Fatal("Failed to run migrations:", err)
 	}
 
+	// Load JWT signing keys
+	keys, err := auth.LoadKeySet(cfg)
+	if err != nil {
+		log.Fatal("Failed to load JWT signing keys:", err)
+	}
+
 	// Set Gin mode
 	if cfg.Environment == "production" {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
 	// Initialize router
-	router := gin.Default()
+	router, err := middleware.NewEngine(cfg)
+	if err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
 
 	// Setup routes
-	api.SetupRoutes(router, db, cfg)
+	api.SetupRoutes(router, db, cfg, keys)
+
+	// Start the notification outbox worker
+	workerCtx, stopWorker := context.WithCancel(context.Background())
+	worker := notify.NewWorker(db, notify.NewDispatcher(cfg), cfg)
+	go worker.Run(workerCtx)
 
 	// Start server
 	port := os.Getenv("PORT")
@@ -45,8 +68,54 @@ func main() {
 
 	// Listen on all interfaces (0.0.0.0)
 	address := "0.0.0.0:" + port
-	log.Printf("Server starting on %s", address)
-	if err := router.Run(address); err != nil {
-		log.Fatal("Failed to start server:", err)
+	server := &http.Server{Addr: address, Handler: router}
+
+	go func() {
+		log.Printf("Server starting on %s", address)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Failed to start server:", err)
+		}
+	}()
+
+	// Start the authenticating reverse proxy when a route table is configured
+	var proxyServer *http.Server
+	if cfg.ProxyRoutesFile != "" {
+		proxyRouter, err := middleware.NewEngine(cfg)
+		if err != nil {
+			log.Fatal("Invalid TRUSTED_PROXIES:", err)
+		}
+		if err := api.SetupProxyRoutes(proxyRouter, db, cfg, keys); err != nil {
+			log.Fatal("Failed to load proxy routes:", err)
+		}
+
+		proxyAddress := "0.0.0.0:" + cfg.ProxyPort
+		proxyServer = &http.Server{Addr: proxyAddress, Handler: proxyRouter}
+		go func() {
+			log.Printf("Proxy starting on %s", proxyAddress)
+			if err := proxyServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal("Failed to start proxy:", err)
+			}
+		}()
 	}
+
+	// Wait for an interrupt, then stop accepting requests and drain the outbox
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Println("Shutting down server...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Server shutdown error: %v", err)
+	}
+	if proxyServer != nil {
+		if err := proxyServer.Shutdown(ctx); err != nil {
+			log.Printf("Proxy shutdown error: %v", err)
+		}
+	}
+
+	stopWorker()
+	<-worker.Done()
+	log.Println("Server stopped")
 }
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"tounetcore/internal/auth"
 	"tounetcore/internal/config"
 	"tounetcore/internal/handlers"
 	"tounetcore/internal/middleware"
@@ -10,14 +11,55 @@ import (
 )
 
 // SetupRoutes configures all API routes
-func SetupRoutes(router *gin.Engine, db *gorm.DB, cfg *config.Config) {
+func SetupRoutes(router *gin.Engine, db *gorm.DB, cfg *config.Config, keys *auth.KeySet) {
 	// Add middleware
 	router.Use(middleware.CORSMiddleware())
 
 	// Initialize handlers
-	userHandler := handlers.NewUserHandler(db, cfg)
+	userHandler := handlers.NewUserHandler(db, cfg, keys)
 	nkeyHandler := handlers.NewNKeyHandler(db, cfg)
 	adminHandler := handlers.NewAdminHandler(db, cfg)
+	webAuthnHandler := handlers.NewWebAuthnHandler(db, cfg, keys)
+	passwordResetHandler := handlers.NewPasswordResetHandler(db, cfg)
+	keysHandler := handlers.NewKeysHandler(keys)
+	oidcHandler := handlers.NewOIDCHandler(db, cfg, keys)
+	forwardAuthHandler := handlers.NewForwardAuthHandler(db, cfg, keys)
+	ssoHandler := handlers.NewSSOHandler(db, cfg, keys)
+	casHandler := handlers.NewCASHandler(db, cfg, keys)
+
+	// Public keys for verifying access tokens
+	router.GET("/.well-known/jwks.json", keysHandler.JWKS)
+
+	// OpenID Connect provider
+	router.GET("/.well-known/openid-configuration", oidcHandler.Discovery)
+	oauth := router.Group("/oauth")
+	{
+		oauth.GET("/authorize", oidcHandler.Authorize)
+		oauth.POST("/token", oidcHandler.Token)
+		oauth.POST("/introspect", oidcHandler.Introspect)
+		oauth.POST("/revoke", oidcHandler.Revoke)
+		oauth.GET("/userinfo", middleware.ClientTokenMiddleware(db, keys, cfg.OIDCIssuer), oidcHandler.UserInfo)
+		oauth.POST("/userinfo", middleware.ClientTokenMiddleware(db, keys, cfg.OIDCIssuer), oidcHandler.UserInfo)
+		oauth.GET("/logout", oidcHandler.EndSession)
+	}
+
+	// Browser single sign-on
+	sso := router.Group("/sso")
+	{
+		sso.GET("/login", ssoHandler.LoginPage)
+		sso.POST("/login", ssoHandler.Login)
+		sso.POST("/logout", ssoHandler.Logout)
+		sso.GET("/launch/:app_id", ssoHandler.Launch)
+	}
+
+	// CAS protocol for legacy services
+	cas := router.Group("/cas")
+	{
+		cas.GET("/login", casHandler.Login)
+		cas.GET("/serviceValidate", casHandler.ServiceValidate)
+		cas.GET("/p3/serviceValidate", casHandler.ServiceValidate)
+		cas.GET("/logout", casHandler.Logout)
+	}
 
 	// API v1 routes
 	v1 := router.Group("/api/v1")
@@ -25,28 +67,66 @@ func SetupRoutes(router *gin.Engine, db *gorm.DB, cfg *config.Config) {
 		// Public routes
 		v1.POST("/register", userHandler.Register)
 		v1.POST("/login", userHandler.Login)
-		v1.POST("/nkey/validate", nkeyHandler.ValidateNKey)
+		v1.POST("/login/2fa", userHandler.LoginMFA)
+		v1.POST("/token/refresh", userHandler.RefreshToken)
+		v1.POST("/password-reset/request", passwordResetHandler.RequestReset)
+		v1.POST("/password-reset/confirm", passwordResetHandler.ConfirmReset)
+		v1.POST("/nkey/validate", middleware.AppAuthMiddleware(db), nkeyHandler.ValidateNKey)
+		v1.GET("/nkey/public-key", nkeyHandler.PublicKey)
+		v1.GET("/nkey/revoked", middleware.AppAuthMiddleware(db), nkeyHandler.RevocationList)
+		v1.GET("/forward-auth", forwardAuthHandler.ForwardAuth)
+		v1.POST("/webauthn/login/begin", webAuthnHandler.BeginLogin)
+		v1.POST("/webauthn/login/finish", webAuthnHandler.FinishLogin)
 
 		// Protected routes (require authentication)
 		protected := v1.Group("")
-		protected.Use(middleware.AuthMiddleware(cfg.JWTSecret))
+		protected.Use(middleware.AuthMiddleware(db, keys))
 		{
+			protected.POST("/logout", userHandler.Logout)
+
+			// Two-factor enrollment stays reachable for users the 2FA policy is blocking
+			twoFactor := protected.Group("/user/2fa")
+			{
+				twoFactor.POST("/setup", userHandler.SetupTOTP)
+				twoFactor.POST("/verify", userHandler.VerifyTOTP)
+				twoFactor.POST("/disable", userHandler.DisableTOTP)
+			}
+
+			// Passkey management also counts as 2FA enrollment
+			passkeys := protected.Group("/webauthn")
+			{
+				passkeys.POST("/register/begin", webAuthnHandler.BeginRegistration)
+				passkeys.POST("/register/finish", webAuthnHandler.FinishRegistration)
+				passkeys.GET("/credentials", webAuthnHandler.ListCredentials)
+				passkeys.POST("/credentials/:id/delete", webAuthnHandler.DeleteCredential)
+			}
+
+			// Routes below require 2FA when the user's role is covered by the policy
+			enrolled := protected.Group("")
+			enrolled.Use(middleware.MFAEnrollmentMiddleware(cfg))
+
 			// User routes
-			user := protected.Group("/user")
+			user := enrolled.Group("/user")
 			{
 				user.GET("/me", userHandler.GetUserInfo)
 				user.PUT("/me", userHandler.UpdateUser)
+				user.PUT("/me/password", userHandler.ChangePassword)
 				user.GET("/apps", userHandler.ListAllowedApps)
+				user.GET("/nkeys", nkeyHandler.ListNKeys)
+				user.POST("/nkeys/:id/revoke", nkeyHandler.RevokeNKey)
 			}
 
+			// OIDC consent, called by the login page for the signed-in user
+			enrolled.POST("/oauth/authorize", oidcHandler.Consent)
+
 			// NKey routes
-			nkey := protected.Group("/nkey")
+			nkey := enrolled.Group("/nkey")
 			{
 				nkey.POST("/generate", nkeyHandler.ApplyNKey)
 			}
 
 			// Admin routes (require admin role)
-			admin := protected.Group("/admin")
+			admin := enrolled.Group("/admin")
 			admin.Use(middleware.AdminMiddleware())
 			{
 				// User management
@@ -54,6 +134,33 @@ func SetupRoutes(router *gin.Engine, db *gorm.DB, cfg *config.Config) {
 				admin.GET("/users", adminHandler.ListUsers)
 				admin.POST("/users/:user_id/update", adminHandler.UpdateUser)
 				admin.POST("/users/:user_id/delete", adminHandler.DeleteUser)
+				admin.POST("/users/:user_id/revoke-sessions", adminHandler.RevokeUserSessions)
+				admin.POST("/users/:user_id/2fa/reset", adminHandler.ResetUserTOTP)
+				admin.POST("/users/:user_id/unlock", adminHandler.UnlockUser)
+
+				// NKey revocation
+				admin.GET("/users/:user_id/nkeys", adminHandler.ListUserNKeys)
+				admin.POST("/users/:user_id/nkeys/revoke", adminHandler.RevokeUserNKeys)
+				admin.POST("/apps/:app_id/nkeys/revoke", adminHandler.RevokeAppNKeys)
+				admin.POST("/nkeys/:id/revoke", adminHandler.RevokeNKey)
+
+				// Per-user app grants
+				admin.GET("/users/:user_id/apps", adminHandler.ListUserGrants)
+				admin.POST("/users/:user_id/apps", adminHandler.SetUserGrants)
+				admin.POST("/users/:user_id/apps/delete", adminHandler.DeleteUserGrants)
+				admin.PUT("/users/:user_id/apps/:app_id", adminHandler.SetUserGrant)
+				admin.DELETE("/users/:user_id/apps/:app_id", adminHandler.DeleteUserGrant)
+				admin.GET("/apps/:app_id/users", adminHandler.ListAppGrants)
+				admin.POST("/apps/:app_id/users", adminHandler.SetAppGrants)
+				admin.POST("/apps/:app_id/users/delete", adminHandler.DeleteAppGrants)
+
+				// Login lockouts
+				admin.GET("/lockouts", adminHandler.ListLockouts)
+				admin.POST("/lockouts/unlock", adminHandler.UnlockLogin)
+
+				// Notification outbox
+				admin.GET("/notifications", adminHandler.ListNotifications)
+				admin.POST("/notifications/:id/retry", adminHandler.RetryNotification)
 
 				// Invite code management
 				admin.POST("/invite-codes", adminHandler.GenerateInviteCode)
@@ -83,3 +190,14 @@ func SetupRoutes(router *gin.Engine, db *gorm.DB, cfg *config.Config) {
 		})
 	})
 }
+
+// SetupProxyRoutes sends every request through the authenticating reverse proxy
+func SetupProxyRoutes(router *gin.Engine, db *gorm.DB, cfg *config.Config, keys *auth.KeySet) error {
+	proxyHandler, err := handlers.NewProxyHandler(db, cfg, keys)
+	if err != nil {
+		return err
+	}
+
+	router.NoRoute(proxyHandler.Proxy)
+	return nil
+}
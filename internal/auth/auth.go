@@ -2,9 +2,14 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math/big"
+	"strconv"
+	"sync"
 	"time"
 	"tounetcore/internal/models"
 
@@ -17,6 +22,13 @@ type Claims struct {
 	UserID   uint              `json:"user_id"`
 	Username string            `json:"username"`
 	Status   models.UserStatus `json:"status"`
+	// SessionID is the refresh token family the access token was issued for
+	SessionID string `json:"sid"`
+	// ClientID and Scope are set on access tokens issued to OIDC clients
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	// TokenType is set on browser SSO session tokens
+	TokenType string `json:"token_type,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -35,53 +47,154 @@ func CheckPassword(password, hash string) bool {
 	return err == nil
 }
 
-// GenerateJWT generates a JWT token for a user
-func GenerateJWT(user *models.User, secret string, expiration time.Duration) (string, error) {
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// CheckPasswordDummy runs a bcrypt comparison against a throwaway hash so that
+// rejecting an unknown username takes as long as rejecting a wrong password
+func CheckPasswordDummy(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("tounetcore-dummy-password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// GenerateJWT generates a JWT access token for a user bound to a session
+func GenerateJWT(user *models.User, sessionID string, keys *KeySet, expiration time.Duration) (string, error) {
+	tokenID, err := GenerateTokenID()
+	if err != nil {
+		return "", err
+	}
+
 	claims := &Claims{
-		UserID:   user.ID,
-		Username: user.Username,
-		Status:   user.Status,
+		UserID:    user.ID,
+		Username:  user.Username,
+		Status:    user.Status,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiration)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+	return keys.Sign(claims)
+}
+
+// mfaAudience marks tokens that only prove the password step of a two-step login. The
+// audience keeps them out of the TouNetCore API; the token type identifies them, since an
+// OIDC client token's audience is an app ID and could be the same string.
+const (
+	mfaAudience  = "mfa_pending"
+	tokenTypeMFA = "mfa_pending"
+)
+
+// mfaClaims are the claims of an MFA pending token
+type mfaClaims struct {
+	TokenType string `json:"token_type"`
+	jwt.RegisteredClaims
+}
+
+// GenerateMFAToken generates a short-lived token issued after the password step when 2FA is enabled
+func GenerateMFAToken(userID uint, keys *KeySet, expiration time.Duration) (string, error) {
+	claims := &mfaClaims{
+		TokenType: tokenTypeMFA,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   fmt.Sprintf("%d", userID),
+			Audience:  jwt.ClaimStrings{mfaAudience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiration)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	return keys.Sign(claims)
+}
+
+// ValidateMFAToken validates an MFA pending token and returns the user ID
+func ValidateMFAToken(tokenString string, keys *KeySet) (uint, error) {
+	claims := &mfaClaims{}
+	token, err := keys.Parse(tokenString, claims, jwt.WithAudience(mfaAudience))
+	if err != nil {
+		return 0, err
+	}
+	if !token.Valid || claims.TokenType != tokenTypeMFA {
+		return 0, errors.New("invalid token")
+	}
+
+	userID, err := strconv.ParseUint(claims.Subject, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid token subject")
+	}
+	return uint(userID), nil
 }
 
 // ValidateJWT validates a JWT token and returns the claims
-func ValidateJWT(tokenString, secret string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(secret), nil
-	})
+func ValidateJWT(tokenString string, keys *KeySet) (*Claims, error) {
+	token, err := keys.Parse(tokenString, &Claims{})
 
 	if err != nil {
 		return nil, err
 	}
 
 	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+		// MFA pending and OIDC client tokens are signed with the same keys but
+		// are not TouNetCore access tokens; both carry an audience
+		if len(claims.Audience) > 0 {
+			return nil, errors.New("invalid token")
+		}
 		return claims, nil
 	}
 
 	return nil, errors.New("invalid token")
 }
 
-// GenerateNKey generates a new Nkey for authorization
-func GenerateNKey(userID uint, appIDs []string) (string, error) {
-	// Generate random bytes
+// GenerateRefreshToken generates an opaque refresh token
+func GenerateRefreshToken() (string, error) {
 	bytes := make([]byte, 32)
 	if _, err := rand.Read(bytes); err != nil {
 		return "", err
 	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// GenerateSessionID generates a random identifier for a refresh token family
+func GenerateSessionID() (string, error) {
+	return randomHex(16)
+}
+
+// GenerateTokenID generates a random identifier used as the JWT "jti" claim
+func GenerateTokenID() (string, error) {
+	return randomHex(16)
+}
+
+// randomHex returns n random bytes encoded as hex
+func randomHex(n int) (string, error) {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
 
-	// Create the key with prefix
-	key := fmt.Sprintf("TOUNET_%d_%s", userID, base64.URLEncoding.EncodeToString(bytes))
-	return key, nil
+// HashToken returns the SHA-256 hex digest of a token for storage
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateNumericCode generates a random numeric one-time code of the given length
+func GenerateNumericCode(digits int) (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < digits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", digits, n), nil
 }
 
 // GenerateInviteCode generates a random invite code
@@ -0,0 +1,375 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"tounetcore/internal/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported JWT signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// unknownKidReloadInterval limits how often an unknown kid triggers a key directory reload
+const unknownKidReloadInterval = 10 * time.Second
+
+// SigningKey is a JWT key identified by its kid
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	private   interface{}
+	public    interface{}
+}
+
+// method returns the jwt signing method for the key's algorithm
+func (k *SigningKey) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// KeySet holds the key new tokens are signed with and every key tokens are verified with.
+// With an asymmetric algorithm the keys are the PEM files in the keys directory: the newest
+// (by file name) signs, all of them verify. With HS256 the JWT secret is the only key.
+type KeySet struct {
+	dir            string
+	reloadInterval time.Duration
+
+	mu         sync.RWMutex
+	keys       map[string]*SigningKey
+	active     *SigningKey
+	loadedAt   time.Time
+	lastReload time.Time
+}
+
+// LoadKeySet loads the JWT signing keys selected by the configuration. If an asymmetric
+// algorithm is configured and the keys directory has no keys, a first key is generated.
+func LoadKeySet(cfg *config.Config) (*KeySet, error) {
+	if cfg.JWTAlgorithm == AlgHS256 {
+		key := &SigningKey{Algorithm: AlgHS256, private: []byte(cfg.JWTSecret), public: []byte(cfg.JWTSecret)}
+		return &KeySet{
+			keys:   map[string]*SigningKey{"": key},
+			active: key,
+		}, nil
+	}
+
+	if cfg.JWTKeysDir == "" {
+		return nil, errors.New("JWT_KEYS_DIR is required for " + cfg.JWTAlgorithm)
+	}
+	if err := os.MkdirAll(cfg.JWTKeysDir, 0700); err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{dir: cfg.JWTKeysDir, reloadInterval: cfg.JWTKeysReloadInterval}
+	if err := ks.Reload(); err != nil {
+		return nil, err
+	}
+	if ks.active == nil {
+		kid, err := GenerateKeyFile(cfg.JWTKeysDir, cfg.JWTAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Generated JWT signing key %s in %s", kid, cfg.JWTKeysDir)
+		if err := ks.Reload(); err != nil {
+			return nil, err
+		}
+	}
+	return ks, nil
+}
+
+// Reload re-reads the keys directory
+func (ks *KeySet) Reload() error {
+	if ks.dir == "" {
+		return nil
+	}
+
+	keys, active, err := readKeyDir(ks.dir)
+	if err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.lastReload = time.Now()
+	if len(keys) == 0 && ks.active != nil {
+		// Never drop every key because of a transient directory problem
+		return errors.New("keys directory is empty")
+	}
+	ks.keys = keys
+	ks.active = active
+	ks.loadedAt = time.Now()
+	return nil
+}
+
+// maybeReload reloads the keys directory when the reload interval has passed,
+// or sooner when force is set (an unknown kid was seen)
+func (ks *KeySet) maybeReload(force bool) {
+	if ks.dir == "" {
+		return
+	}
+	ks.mu.RLock()
+	due := ks.reloadInterval > 0 && time.Since(ks.loadedAt) > ks.reloadInterval
+	if force {
+		due = time.Since(ks.lastReload) > unknownKidReloadInterval
+	}
+	ks.mu.RUnlock()
+
+	if due {
+		if err := ks.Reload(); err != nil {
+			log.Printf("Failed to reload JWT keys: %v", err)
+		}
+	}
+}
+
+// Sign signs claims with the active key and sets the kid header
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	ks.maybeReload(false)
+
+	ks.mu.RLock()
+	key := ks.active
+	ks.mu.RUnlock()
+	if key == nil {
+		return "", errors.New("no active signing key")
+	}
+
+	token := jwt.NewWithClaims(key.method(), claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString(key.private)
+}
+
+// Parse verifies a token with the key named by its kid header
+func (ks *KeySet) Parse(tokenString string, claims jwt.Claims, options ...jwt.ParserOption) (*jwt.Token, error) {
+	ks.maybeReload(false)
+
+	return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key := ks.lookup(kid)
+		if key == nil {
+			// The key may have been added by another instance since the last reload
+			ks.maybeReload(true)
+			if key = ks.lookup(kid); key == nil {
+				return nil, fmt.Errorf("unknown signing key %q", kid)
+			}
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.public, nil
+	}, options...)
+}
+
+// Algorithm returns the algorithm of the active signing key
+func (ks *KeySet) Algorithm() string {
+	ks.maybeReload(false)
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if ks.active == nil {
+		return ""
+	}
+	return ks.active.Algorithm
+}
+
+func (ks *KeySet) lookup(kid string) *SigningKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.keys[kid]
+}
+
+// JWKS returns the public verification keys as a JSON Web Key Set.
+// HS256 secrets are never published.
+func (ks *KeySet) JWKS() map[string]interface{} {
+	ks.maybeReload(false)
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	ids := make([]string, 0, len(ks.keys))
+	for id := range ks.keys {
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+
+	jwks := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		if jwk := publicJWK(ks.keys[id]); jwk != nil {
+			jwks = append(jwks, jwk)
+		}
+	}
+	return map[string]interface{}{"keys": jwks}
+}
+
+// publicJWK encodes a key's public half as a JWK, or nil for symmetric keys
+func publicJWK(key *SigningKey) map[string]interface{} {
+	jwk := map[string]interface{}{
+		"kid": key.ID,
+		"alg": key.Algorithm,
+		"use": "sig",
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	switch pub := key.public.(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = b64(pub.N.Bytes())
+		jwk["e"] = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk["kty"] = "EC"
+		jwk["crv"] = pub.Curve.Params().Name
+		jwk["x"] = b64(pub.X.FillBytes(make([]byte, size)))
+		jwk["y"] = b64(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk["kty"] = "OKP"
+		jwk["crv"] = "Ed25519"
+		jwk["x"] = b64(pub)
+	default:
+		return nil
+	}
+	return jwk
+}
+
+// readKeyDir loads every *.pem private key in dir. The kid is the file name without
+// extension and the lexically greatest kid is the active signing key.
+func readKeyDir(dir string) (map[string]*SigningKey, *SigningKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(paths)
+
+	keys := make(map[string]*SigningKey)
+	var active *SigningKey
+	for _, path := range paths {
+		key, err := readKeyFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys[key.ID] = key
+		active = key
+	}
+	return keys, active, nil
+}
+
+// readKeyFile parses a PKCS#8 PEM private key and infers its JWT algorithm
+func readKeyFile(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{
+		ID:      strings.TrimSuffix(filepath.Base(path), ".pem"),
+		private: parsed,
+	}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Algorithm = AlgRS256
+		key.public = &k.PublicKey
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 ECDSA keys are supported")
+		}
+		key.Algorithm = AlgES256
+		key.public = &k.PublicKey
+	case ed25519.PrivateKey:
+		key.Algorithm = AlgEdDSA
+		key.public = k.Public()
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+	return key, nil
+}
+
+// GenerateKeyFile writes a new private key for the algorithm to dir and returns its kid.
+// Kids start with a UTC timestamp so the newest key sorts last and becomes active.
+func GenerateKeyFile(dir, algorithm string) (string, error) {
+	var private crypto.Signer
+	var err error
+	switch algorithm {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return "", fmt.Errorf("unsupported JWT algorithm %q", algorithm)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	kid := time.Now().UTC().Format("20060102T150405.000Z") + "-" + hex.EncodeToString(suffix)
+
+	// Write to a temporary name first so a reload never sees a partial file
+	path := filepath.Join(dir, kid+".pem")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	return kid, nil
+}
+
+// PruneKeyFiles removes all but the newest keep keys from dir and returns the removed kids
+func PruneKeyFiles(dir string, keep int) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var removed []string
+	for len(paths) > keep {
+		if err := os.Remove(paths[0]); err != nil {
+			return removed, err
+		}
+		removed = append(removed, strings.TrimSuffix(filepath.Base(paths[0]), ".pem"))
+		paths = paths[1:]
+	}
+	return removed, nil
+}
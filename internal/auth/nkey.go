@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"tounetcore/internal/config"
+	"tounetcore/internal/models"
+)
+
+const (
+	// NKeyFormatOpaque is a random reference key that apps validate online
+	NKeyFormatOpaque = "opaque"
+	// NKeyFormatSigned is a self-contained Ed25519 signed key apps can verify offline
+	NKeyFormatSigned = "signed"
+
+	// signedNKeyPrefix marks signed NKeys: TOUNETS1.<base64url payload>.<base64url signature>
+	signedNKeyPrefix = "TOUNETS1"
+)
+
+var (
+	ErrInvalidNKey = errors.New("invalid nkey")
+	ErrExpiredNKey = errors.New("expired nkey")
+)
+
+// NKeyClaims describes who an NKey was issued to and for which apps.
+// Signed NKeys carry these claims verbatim.
+type NKeyClaims struct {
+	UserID    uint              `json:"uid"`
+	Username  string            `json:"sub"`
+	Role      models.UserStatus `json:"role"`
+	AppIDs    []string          `json:"apps"`
+	ExpiresAt int64             `json:"exp"`
+	IssuedAt  int64             `json:"iat"`
+	Nonce     string            `json:"nonce"`
+	SingleUse bool              `json:"single_use,omitempty"`
+	KeyID     string            `json:"kid,omitempty"`
+}
+
+// GenerateNKey generates a new NKey in the format selected by cfg.NKeyFormat.
+// IssuedAt, Nonce and KeyID are filled in on the given claims.
+func GenerateNKey(cfg *config.Config, claims *NKeyClaims) (string, error) {
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	claims.Nonce = nonce
+	claims.IssuedAt = time.Now().Unix()
+
+	if cfg.NKeyFormat != NKeyFormatSigned {
+		// Generate random bytes
+		bytes := make([]byte, 32)
+		if _, err := rand.Read(bytes); err != nil {
+			return "", err
+		}
+
+		// Create the key with prefix
+		return fmt.Sprintf("TOUNET_%d_%s", claims.UserID, base64.URLEncoding.EncodeToString(bytes)), nil
+	}
+
+	key, kid, err := nkeySigningKey(cfg)
+	if err != nil {
+		return "", err
+	}
+	claims.KeyID = kid
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := signedNKeyPrefix + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(key, []byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// IsSignedNKey reports whether an NKey uses the signed format
+func IsSignedNKey(nkey string) bool {
+	return strings.HasPrefix(nkey, signedNKeyPrefix+".")
+}
+
+// VerifySignedNKey checks the signature and expiry of a signed NKey and returns its claims.
+// This is the same check apps perform offline with the published public key.
+func VerifySignedNKey(nkey string, publicKey ed25519.PublicKey) (*NKeyClaims, error) {
+	parts := strings.Split(nkey, ".")
+	if len(parts) != 3 || parts[0] != signedNKeyPrefix {
+		return nil, ErrInvalidNKey
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(publicKey, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidNKey
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidNKey
+	}
+	var claims NKeyClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidNKey
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return &claims, ErrExpiredNKey
+	}
+	return &claims, nil
+}
+
+// NKeyPublicKey returns the public key and key ID apps use to verify signed NKeys
+func NKeyPublicKey(cfg *config.Config) (ed25519.PublicKey, string, error) {
+	key, kid, err := nkeySigningKey(cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	return key.Public().(ed25519.PublicKey), kid, nil
+}
+
+var (
+	nkeyKeyMu   sync.Mutex
+	nkeyKeyPath string
+	nkeyKey     ed25519.PrivateKey
+	nkeyKeyID   string
+)
+
+// nkeySigningKey loads the NKey signing key once. A missing key file is created
+// with a new key; without a configured file an ephemeral key is used.
+func nkeySigningKey(cfg *config.Config) (ed25519.PrivateKey, string, error) {
+	nkeyKeyMu.Lock()
+	defer nkeyKeyMu.Unlock()
+
+	if nkeyKey != nil && nkeyKeyPath == cfg.NKeySigningKeyFile {
+		return nkeyKey, nkeyKeyID, nil
+	}
+
+	var key ed25519.PrivateKey
+	var err error
+	if cfg.NKeySigningKeyFile == "" {
+		log.Println("NKEY_SIGNING_KEY_FILE not set, signed NKeys will not survive a restart")
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		key, err = loadOrCreateEd25519Key(cfg.NKeySigningKeyFile)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	sum := sha256.Sum256(key.Public().(ed25519.PublicKey))
+	nkeyKey = key
+	nkeyKeyID = hex.EncodeToString(sum[:8])
+	nkeyKeyPath = cfg.NKeySigningKeyFile
+	return nkeyKey, nkeyKeyID, nil
+}
+
+// loadOrCreateEd25519Key reads a PKCS#8 PEM Ed25519 private key, generating it if the file does not exist
+func loadOrCreateEd25519Key(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		pemData := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(path, pemData, 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return key, nil
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+	"tounetcore/internal/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// PKCEMethodS256 is the only supported PKCE code challenge method
+const PKCEMethodS256 = "S256"
+
+// IDTokenClaims represents the claims of an OIDC ID token
+type IDTokenClaims struct {
+	Nonce             string            `json:"nonce,omitempty"`
+	AuthTime          int64             `json:"auth_time,omitempty"`
+	SessionID         string            `json:"sid,omitempty"`
+	PreferredUsername string            `json:"preferred_username,omitempty"`
+	Role              models.UserStatus `json:"role,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// GenerateClientAccessToken generates an access token for an OIDC client. The token is
+// bound to the client by its audience, so it is not accepted by the TouNetCore API.
+func GenerateClientAccessToken(user *models.User, sessionID, clientID, scope, issuer string, keys *KeySet, expiration time.Duration) (string, error) {
+	tokenID, err := GenerateTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	claims := &Claims{
+		UserID:    user.ID,
+		Username:  user.Username,
+		Status:    user.Status,
+		SessionID: sessionID,
+		ClientID:  clientID,
+		Scope:     scope,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
+			Issuer:    issuer,
+			Subject:   fmt.Sprintf("%d", user.ID),
+			Audience:  jwt.ClaimStrings{clientID},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiration)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	return keys.Sign(claims)
+}
+
+// ValidateClientAccessToken validates an access token issued to an OIDC client
+func ValidateClientAccessToken(tokenString string, keys *KeySet, issuer string) (*Claims, error) {
+	token, err := keys.Parse(tokenString, &Claims{}, jwt.WithIssuer(issuer))
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid || claims.ClientID == "" || len(claims.Audience) != 1 || claims.Audience[0] != claims.ClientID {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+// GenerateIDToken signs an ID token. Issuer, subject and audience must be set by the caller.
+// With HS256 the JWT secret is never shared, so the token is signed with the client's
+// secret instead, as OpenID Connect specifies for symmetric signatures.
+func GenerateIDToken(claims *IDTokenClaims, keys *KeySet, clientSecret string, expiration time.Duration) (string, error) {
+	tokenID, err := GenerateTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	claims.ID = tokenID
+	claims.IssuedAt = jwt.NewNumericDate(time.Now())
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(expiration))
+
+	if keys.Algorithm() == AlgHS256 {
+		if clientSecret == "" {
+			return "", errors.New("client secret required for HS256 id token")
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(clientSecret))
+	}
+	return keys.Sign(claims)
+}
+
+// ParseIDTokenHint verifies an ID token passed back as a logout hint. The token
+// may have expired, but it must have been signed by us for the given issuer.
+// With HS256 it is verified with the secret clientSecret returns for its audience.
+func ParseIDTokenHint(tokenString string, keys *KeySet, issuer string, clientSecret func(clientID string) (string, error)) (*IDTokenClaims, error) {
+	claims := &IDTokenClaims{}
+	var token *jwt.Token
+	var err error
+	if keys.Algorithm() == AlgHS256 {
+		token, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+			if len(claims.Audience) != 1 {
+				return nil, errors.New("invalid id token hint")
+			}
+			secret, err := clientSecret(claims.Audience[0])
+			if err != nil || secret == "" {
+				return nil, errors.New("unknown client")
+			}
+			return []byte(secret), nil
+		}, jwt.WithValidMethods([]string{AlgHS256}), jwt.WithoutClaimsValidation())
+	} else {
+		token, err = keys.Parse(tokenString, claims, jwt.WithoutClaimsValidation())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || claims.Issuer != issuer || len(claims.Audience) != 1 {
+		return nil, errors.New("invalid id token hint")
+	}
+	return claims, nil
+}
+
+// VerifyPKCE checks a PKCE code verifier against the S256 code challenge
+func VerifyPKCE(verifier, challenge string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
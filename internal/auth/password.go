@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// PasswordPolicy describes the rules a new password must satisfy
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// HistorySize is the number of previous passwords that may not be reused
+	HistorySize int
+
+	denylist map[string]struct{}
+}
+
+// PasswordPolicyError describes why a password was rejected
+type PasswordPolicyError struct {
+	Reason string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return e.Reason
+}
+
+// LoadDenylist loads a breached or forbidden password list, one password per line.
+// Lines starting with # are ignored and entries are compared case-insensitively.
+func (p *PasswordPolicy) LoadDenylist(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	denylist := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		denylist[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	p.denylist = denylist
+	return nil
+}
+
+// Validate checks a password against the policy. The username is used to reject
+// passwords that merely repeat the account name.
+func (p *PasswordPolicy) Validate(password, username string) error {
+	if len([]rune(password)) < p.MinLength {
+		return &PasswordPolicyError{Reason: fmt.Sprintf("password must be at least %d characters", p.MinLength)}
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+	if p.RequireUpper && !hasUpper {
+		return &PasswordPolicyError{Reason: "password must contain an uppercase letter"}
+	}
+	if p.RequireLower && !hasLower {
+		return &PasswordPolicyError{Reason: "password must contain a lowercase letter"}
+	}
+	if p.RequireDigit && !hasDigit {
+		return &PasswordPolicyError{Reason: "password must contain a digit"}
+	}
+	if p.RequireSymbol && !hasSymbol {
+		return &PasswordPolicyError{Reason: "password must contain a symbol"}
+	}
+
+	lower := strings.ToLower(password)
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		return &PasswordPolicyError{Reason: "password must not contain the username"}
+	}
+	if _, denied := p.denylist[lower]; denied {
+		return &PasswordPolicyError{Reason: "password is too common or has appeared in a breach"}
+	}
+
+	return nil
+}
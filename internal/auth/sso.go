@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"tounetcore/internal/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ssoAudience marks tokens stored in the browser SSO session cookie. The audience keeps
+// them out of the TouNetCore API; the token type identifies them, since an OIDC client
+// token's audience is an app ID and could be the same string.
+const (
+	ssoAudience  = "tounet_sso"
+	tokenTypeSSO = "sso"
+)
+
+// GenerateSSOToken generates the token for the browser SSO session cookie. It carries
+// an audience, so it cannot be replayed as a TouNetCore API access token.
+func GenerateSSOToken(user *models.User, sessionID string, keys *KeySet, expiration time.Duration) (string, error) {
+	tokenID, err := GenerateTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	claims := &Claims{
+		UserID:    user.ID,
+		Username:  user.Username,
+		Status:    user.Status,
+		SessionID: sessionID,
+		TokenType: tokenTypeSSO,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
+			Subject:   fmt.Sprintf("%d", user.ID),
+			Audience:  jwt.ClaimStrings{ssoAudience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiration)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	return keys.Sign(claims)
+}
+
+// ValidateSSOToken validates a browser SSO session token and returns the claims
+func ValidateSSOToken(tokenString string, keys *KeySet) (*Claims, error) {
+	token, err := keys.Parse(tokenString, &Claims{}, jwt.WithAudience(ssoAudience))
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid || claims.SessionID == "" || claims.TokenType != tokenTypeSSO {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+	"tounetcore/internal/config"
+	"tounetcore/internal/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newTestKeySet(t *testing.T) (*config.Config, *KeySet) {
+	t.Helper()
+
+	cfg := config.LoadConfig()
+	cfg.JWTAlgorithm = "HS256"
+	cfg.JWTKeysDir = filepath.Join(t.TempDir(), "jwt_keys")
+	keys, err := LoadKeySet(cfg)
+	if err != nil {
+		t.Fatalf("load keys: %v", err)
+	}
+	return cfg, keys
+}
+
+// A client access token for an app whose ID equals the MFA audience is not an MFA token
+func TestClientTokenIsNotMFAToken(t *testing.T) {
+	cfg, keys := newTestKeySet(t)
+	user := &models.User{ID: 7, Username: "alice", Status: models.StatusUser}
+
+	token, err := GenerateClientAccessToken(user, "family", mfaAudience, "openid", cfg.OIDCIssuer, keys, time.Hour)
+	if err != nil {
+		t.Fatalf("generate client token: %v", err)
+	}
+	if _, err := ValidateMFAToken(token, keys); err == nil {
+		t.Fatal("client token accepted as an MFA token")
+	}
+
+	token, err = GenerateMFAToken(user.ID, keys, time.Minute)
+	if err != nil {
+		t.Fatalf("generate mfa token: %v", err)
+	}
+	if userID, err := ValidateMFAToken(token, keys); err != nil || userID != user.ID {
+		t.Fatalf("mfa token: user %d, %v", userID, err)
+	}
+}
+
+// A client access token for an app whose ID equals the SSO audience is not an SSO session
+func TestClientTokenIsNotSSOToken(t *testing.T) {
+	cfg, keys := newTestKeySet(t)
+	user := &models.User{ID: 7, Username: "alice", Status: models.StatusUser}
+
+	token, err := GenerateClientAccessToken(user, "family", ssoAudience, "openid", cfg.OIDCIssuer, keys, time.Hour)
+	if err != nil {
+		t.Fatalf("generate client token: %v", err)
+	}
+	if _, err := ValidateSSOToken(token, keys); err == nil {
+		t.Fatal("client token accepted as an SSO session")
+	}
+
+	token, err = GenerateSSOToken(user, "family", keys, time.Hour)
+	if err != nil {
+		t.Fatalf("generate sso token: %v", err)
+	}
+	if claims, err := ValidateSSOToken(token, keys); err != nil || claims.UserID != user.ID {
+		t.Fatalf("sso token: %v, %v", claims, err)
+	}
+}
+
+// With HS256, ID tokens are signed with the client secret so clients can verify them
+func TestHS256IDTokenSignedWithClientSecret(t *testing.T) {
+	cfg, keys := newTestKeySet(t)
+	secrets := map[string]string{"wiki": "wiki-secret"}
+	clientSecret := func(clientID string) (string, error) {
+		if secret, ok := secrets[clientID]; ok {
+			return secret, nil
+		}
+		return "", errors.New("unknown client")
+	}
+
+	claims := &IDTokenClaims{SessionID: "family"}
+	claims.Issuer = cfg.OIDCIssuer
+	claims.Subject = "7"
+	claims.Audience = jwt.ClaimStrings{"wiki"}
+	token, err := GenerateIDToken(claims, keys, secrets["wiki"], time.Hour)
+	if err != nil {
+		t.Fatalf("generate id token: %v", err)
+	}
+
+	if _, err := jwt.Parse(token, func(*jwt.Token) (interface{}, error) { return []byte("wiki-secret"), nil }); err != nil {
+		t.Fatalf("verify with client secret: %v", err)
+	}
+	if _, err := keys.Parse(token, &IDTokenClaims{}); err == nil {
+		t.Fatal("id token verifies with the server secret")
+	}
+	if hint, err := ParseIDTokenHint(token, keys, cfg.OIDCIssuer, clientSecret); err != nil || hint.SessionID != "family" {
+		t.Fatalf("id token hint: %v, %v", hint, err)
+	}
+
+	secrets["wiki"] = "rotated"
+	if _, err := ParseIDTokenHint(token, keys, cfg.OIDCIssuer, clientSecret); err == nil {
+		t.Fatal("id token hint accepted after the client secret changed")
+	}
+}
@@ -3,28 +3,129 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	Environment    string
-	DatabaseURL    string
-	JWTSecret      string
-	JWTExpiration  time.Duration
-	NKeyExpiration time.Duration
-	PushDeerAPI    string
-	ServerPort     string
+	Environment             string
+	DatabaseURL             string
+	JWTSecret               string
+	JWTAlgorithm            string
+	JWTKeysDir              string
+	JWTKeysReloadInterval   time.Duration
+	JWTExpiration           time.Duration
+	RefreshTokenExpiration  time.Duration
+	NKeyExpiration          time.Duration
+	NKeyFormat              string
+	NKeySigningKeyFile      string
+	MFAIssuer               string
+	MFATokenExpiration      time.Duration
+	MFARequiredAdmin        bool
+	MFARequiredTrusted      bool
+	PasswordMinLength       int
+	PasswordRequireUpper    bool
+	PasswordRequireLower    bool
+	PasswordRequireDigit    bool
+	PasswordRequireSymbol   bool
+	PasswordHistorySize     int
+	PasswordDenylistFile    string
+	PasswordResetExpiration time.Duration
+	PasswordResetMaxPerHour int
+	SMSWebhookURL           string
+	LoginMaxFailures        int
+	LoginIPMaxFailures      int
+	LoginFailureWindow      time.Duration
+	LoginLockoutDuration    time.Duration
+	WebAuthnRPID            string
+	WebAuthnRPName          string
+	WebAuthnOrigins         []string
+	PushDeerAPI             string
+	NotifyWebhookURL        string
+	SMTPHost                string
+	SMTPPort                int
+	SMTPUsername            string
+	SMTPPassword            string
+	SMTPFrom                string
+	NotifyMaxAttempts       int
+	NotifyRetryBase         time.Duration
+	NotifyPollInterval      time.Duration
+	NotifyDrainTimeout      time.Duration
+	OIDCIssuer              string
+	OIDCLoginURL            string
+	OIDCCodeExpiration      time.Duration
+	OIDCRequirePKCE         bool
+	SessionCookieName       string
+	ForwardAuthLoginURL     string
+	ProxyRoutesFile         string
+	ProxyPort               string
+	SSOSessionExpiration    time.Duration
+	SessionCookieDomain     string
+	SessionCookieSecure     bool
+	SSORedirectHosts        []string
+	TrustedProxies          []string
+	ServerPort              string
 }
 
 func LoadConfig() *Config {
 	return &Config{
-		Environment:    getEnv("ENVIRONMENT", "development"),
-		DatabaseURL:    getEnv("DATABASE_URL", "sqlite://./tounetcore.db"),
-		JWTSecret:      getEnv("JWT_SECRET", "your-super-secret-jwt-key-change-in-production"),
-		JWTExpiration:  getDurationEnv("JWT_EXPIRATION", 24*time.Hour),
-		NKeyExpiration: getDurationEnv("NKEY_EXPIRATION", 15*time.Minute),
-		PushDeerAPI:    getEnv("PUSHDEER_API", "https://api2.pushdeer.com/message/push"),
-		ServerPort:     getEnv("PORT", "44544"),
+		Environment:             getEnv("ENVIRONMENT", "development"),
+		DatabaseURL:             getEnv("DATABASE_URL", "sqlite://./tounetcore.db"),
+		JWTSecret:               getEnv("JWT_SECRET", "your-super-secret-jwt-key-change-in-production"),
+		JWTAlgorithm:            getEnv("JWT_ALGORITHM", "HS256"),
+		JWTKeysDir:              getEnv("JWT_KEYS_DIR", "./jwt_keys"),
+		JWTKeysReloadInterval:   getDurationEnv("JWT_KEYS_RELOAD_INTERVAL", time.Minute),
+		JWTExpiration:           getDurationEnv("JWT_EXPIRATION", 15*time.Minute),
+		RefreshTokenExpiration:  getDurationEnv("REFRESH_TOKEN_EXPIRATION", 30*24*time.Hour),
+		NKeyExpiration:          getDurationEnv("NKEY_EXPIRATION", 15*time.Minute),
+		NKeyFormat:              getEnv("NKEY_FORMAT", "opaque"),
+		NKeySigningKeyFile:      getEnv("NKEY_SIGNING_KEY_FILE", "./nkey_signing_key.pem"),
+		MFAIssuer:               getEnv("MFA_ISSUER", "TouNetCore"),
+		MFATokenExpiration:      getDurationEnv("MFA_TOKEN_EXPIRATION", 5*time.Minute),
+		MFARequiredAdmin:        getBoolEnv("MFA_REQUIRED_ADMIN", true),
+		MFARequiredTrusted:      getBoolEnv("MFA_REQUIRED_TRUSTED", false),
+		PasswordMinLength:       getIntEnv("PASSWORD_MIN_LENGTH", 8),
+		PasswordRequireUpper:    getBoolEnv("PASSWORD_REQUIRE_UPPER", true),
+		PasswordRequireLower:    getBoolEnv("PASSWORD_REQUIRE_LOWER", true),
+		PasswordRequireDigit:    getBoolEnv("PASSWORD_REQUIRE_DIGIT", true),
+		PasswordRequireSymbol:   getBoolEnv("PASSWORD_REQUIRE_SYMBOL", false),
+		PasswordHistorySize:     getIntEnv("PASSWORD_HISTORY_SIZE", 5),
+		PasswordDenylistFile:    getEnv("PASSWORD_DENYLIST_FILE", ""),
+		PasswordResetExpiration: getDurationEnv("PASSWORD_RESET_EXPIRATION", 10*time.Minute),
+		PasswordResetMaxPerHour: getIntEnv("PASSWORD_RESET_MAX_PER_HOUR", 3),
+		SMSWebhookURL:           getEnv("SMS_WEBHOOK_URL", ""),
+		LoginMaxFailures:        getIntEnv("LOGIN_MAX_FAILURES", 5),
+		LoginIPMaxFailures:      getIntEnv("LOGIN_IP_MAX_FAILURES", 20),
+		LoginFailureWindow:      getDurationEnv("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		LoginLockoutDuration:    getDurationEnv("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		WebAuthnRPID:            getEnv("WEBAUTHN_RP_ID", "localhost"),
+		WebAuthnRPName:          getEnv("WEBAUTHN_RP_NAME", "TouNetCore"),
+		WebAuthnOrigins:         getListEnv("WEBAUTHN_ORIGINS", []string{"http://localhost:44544"}),
+		PushDeerAPI:             getEnv("PUSHDEER_API", "https://api2.pushdeer.com/message/push"),
+		NotifyWebhookURL:        getEnv("NOTIFY_WEBHOOK_URL", ""),
+		SMTPHost:                getEnv("SMTP_HOST", ""),
+		SMTPPort:                getIntEnv("SMTP_PORT", 587),
+		SMTPUsername:            getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:            getEnv("SMTP_PASSWORD", ""),
+		SMTPFrom:                getEnv("SMTP_FROM", "tounetcore@localhost"),
+		NotifyMaxAttempts:       getIntEnv("NOTIFY_MAX_ATTEMPTS", 8),
+		NotifyRetryBase:         getDurationEnv("NOTIFY_RETRY_BASE", 30*time.Second),
+		NotifyPollInterval:      getDurationEnv("NOTIFY_POLL_INTERVAL", 5*time.Second),
+		NotifyDrainTimeout:      getDurationEnv("NOTIFY_DRAIN_TIMEOUT", 10*time.Second),
+		OIDCIssuer:              strings.TrimSuffix(getEnv("OIDC_ISSUER", "http://localhost:44544"), "/"),
+		OIDCLoginURL:            getEnv("OIDC_LOGIN_URL", "/login"),
+		OIDCCodeExpiration:      getDurationEnv("OIDC_CODE_EXPIRATION", time.Minute),
+		OIDCRequirePKCE:         getBoolEnv("OIDC_REQUIRE_PKCE", true),
+		SessionCookieName:       getEnv("SESSION_COOKIE_NAME", "tounet_session"),
+		ForwardAuthLoginURL:     getEnv("FORWARD_AUTH_LOGIN_URL", "http://localhost:44544/sso/login"),
+		ProxyRoutesFile:         getEnv("PROXY_ROUTES_FILE", ""),
+		ProxyPort:               getEnv("PROXY_PORT", "44545"),
+		SSOSessionExpiration:    getDurationEnv("SSO_SESSION_EXPIRATION", 12*time.Hour),
+		SessionCookieDomain:     getEnv("SESSION_COOKIE_DOMAIN", ""),
+		SessionCookieSecure:     getBoolEnv("SESSION_COOKIE_SECURE", true),
+		SSORedirectHosts:        getListEnv("SSO_REDIRECT_HOSTS", []string{"localhost"}),
+		TrustedProxies:          getListEnv("TRUSTED_PROXIES", nil),
+		ServerPort:              getEnv("PORT", "44544"),
 	}
 }
 
@@ -52,3 +153,25 @@ func getIntEnv(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+func getBoolEnv(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
+func getListEnv(key string, defaultValue []string) []string {
+	if value := os.Getenv(key); value != "" {
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list
+	}
+	return defaultValue
+}
@@ -40,14 +40,38 @@ func InitDB(databaseURL string) (*gorm.DB, error) {
 
 // RunMigrations runs database migrations
 func RunMigrations(db *gorm.DB) error {
-	return db.AutoMigrate(
+	err := db.AutoMigrate(
 		&models.User{},
 		&models.InviteCode{},
 		&models.NKey{},
 		&models.App{},
 		&models.UserAllowedApp{},
 		&models.AuditLog{},
+		&models.Session{},
+		&models.RevokedToken{},
+		&models.RecoveryCode{},
+		&models.WebAuthnCredential{},
+		&models.WebAuthnCeremony{},
+		&models.LoginThrottle{},
+		&models.PasswordHistory{},
+		&models.PasswordReset{},
+		&models.Notification{},
+		&models.OAuthAuthorizationCode{},
+		&models.UsageCounter{},
 	)
+	if err != nil {
+		return err
+	}
+
+	// Anonymous audit events used to record operator 0, which matches no user
+	if err := db.Model(&models.AuditLog{}).Where("operator_id = ?", 0).Update("operator_id", nil).Error; err != nil {
+		return err
+	}
+
+	// Dead notifications used to keep their bodies, including NKeys and reset codes
+	return db.Model(&models.Notification{}).
+		Where("status = ? AND event IN ? AND body <> ?", models.NotificationDead, models.SecretNotificationEvents, "").
+		Update("body", "").Error
 }
 
 // SeedData seeds initial data into the database
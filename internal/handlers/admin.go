@@ -7,6 +7,7 @@ import (
 	"time"
 	"tounetcore/internal/auth"
 	"tounetcore/internal/config"
+	"tounetcore/internal/middleware"
 	"tounetcore/internal/models"
 
 	"github.com/gin-gonic/gin"
@@ -38,7 +39,11 @@ type CreateAppRequest struct {
 	Description             string            `json:"description"`
 	URL                     string            `json:"url"`
 	RequiredPermissionLevel models.UserStatus `json:"required_permission_level"`
+	AccessMode              models.AccessMode `json:"access_mode"`
 	IsActive                bool              `json:"is_active"`
+	SingleUseNKeys          bool              `json:"single_use_nkeys"`
+	RedirectURIs            []string          `json:"redirect_uris"`
+	PostLogoutRedirectURIs  []string          `json:"post_logout_redirect_uris"`
 }
 
 // UpdateAppRequest represents app update request
@@ -48,7 +53,11 @@ type UpdateAppRequest struct {
 	URL                     string            `json:"url"`
 	SecretKey               string            `json:"secret_key"`
 	RequiredPermissionLevel models.UserStatus `json:"required_permission_level"`
+	AccessMode              models.AccessMode `json:"access_mode"`
 	IsActive                *bool             `json:"is_active"`
+	SingleUseNKeys          *bool             `json:"single_use_nkeys"`
+	RedirectURIs            *[]string         `json:"redirect_uris"`
+	PostLogoutRedirectURIs  *[]string         `json:"post_logout_redirect_uris"`
 }
 
 // AdminUpdateUserRequest represents admin user update request
@@ -81,6 +90,12 @@ func (h *AdminHandler) CreateUser(c *gin.Context) {
 		return
 	}
 
+	// Enforce password policy
+	if err := validateNewPassword(h.db, h.cfg, &models.User{Username: req.Username}, req.Password); err != nil {
+		respondPasswordError(c, err)
+		return
+	}
+
 	// Hash password
 	hashedPassword, err := auth.HashPassword(req.Password)
 	if err != nil {
@@ -110,6 +125,7 @@ func (h *AdminHandler) CreateUser(c *gin.Context) {
 		})
 		return
 	}
+	recordPasswordHistory(h.db, h.cfg, user.ID, user.PasswordHash)
 
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
@@ -149,6 +165,18 @@ func (h *AdminHandler) ListUsers(c *gin.Context) {
 		return
 	}
 
+	// Per-user app grants of the users on this page
+	userIDs := make([]uint, 0, len(users))
+	for _, user := range users {
+		userIDs = append(userIDs, user.ID)
+	}
+	var grants []models.UserAllowedApp
+	h.db.Where("user_id IN ?", userIDs).Order("app_id").Find(&grants)
+	userGrants := make(map[uint][]models.UserAllowedApp)
+	for _, grant := range grants {
+		userGrants[grant.UserID] = append(userGrants[grant.UserID], grant)
+	}
+
 	// Build response
 	var userList []gin.H
 	for _, user := range users {
@@ -159,6 +187,7 @@ func (h *AdminHandler) ListUsers(c *gin.Context) {
 			"phone":      user.Phone,
 			"created_at": user.CreatedAt,
 			"last_login": user.LastLogin,
+			"app_grants": grantList(userGrants[user.ID]),
 		})
 	}
 
@@ -201,6 +230,14 @@ func (h *AdminHandler) CreateApp(c *gin.Context) {
 		return
 	}
 
+	if err := validateRedirectURIs(append(append([]string{}, req.RedirectURIs...), req.PostLogoutRedirectURIs...)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": err.Error(),
+		})
+		return
+	}
+
 	// Check if app_id already exists
 	var existingApp models.App
 	if err := h.db.Where("app_id = ?", req.AppID).First(&existingApp).Error; err == nil {
@@ -225,6 +262,16 @@ func (h *AdminHandler) CreateApp(c *gin.Context) {
 	if req.RequiredPermissionLevel == "" {
 		req.RequiredPermissionLevel = models.StatusUser
 	}
+	if req.AccessMode == "" {
+		req.AccessMode = models.AccessRoleBased
+	}
+	if !req.AccessMode.Valid() {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid access_mode",
+		})
+		return
+	}
 
 	// Create app
 	app := models.App{
@@ -234,7 +281,11 @@ func (h *AdminHandler) CreateApp(c *gin.Context) {
 		Description:             req.Description,
 		URL:                     req.URL,
 		RequiredPermissionLevel: req.RequiredPermissionLevel,
+		AccessMode:              req.AccessMode,
 		IsActive:                req.IsActive,
+		SingleUseNKeys:          req.SingleUseNKeys,
+		RedirectURIs:            encodeStringList(req.RedirectURIs),
+		PostLogoutRedirectURIs:  encodeStringList(req.PostLogoutRedirectURIs),
 	}
 
 	if err := h.db.Create(&app).Error; err != nil {
@@ -254,7 +305,11 @@ func (h *AdminHandler) CreateApp(c *gin.Context) {
 			"url":                       app.URL,
 			"secret_key":                app.SecretKey,
 			"required_permission_level": app.RequiredPermissionLevel,
+			"access_mode":               app.AccessMode,
 			"is_active":                 app.IsActive,
+			"single_use_nkeys":          app.SingleUseNKeys,
+			"redirect_uris":             decodeStringList(app.RedirectURIs),
+			"post_logout_redirect_uris": decodeStringList(app.PostLogoutRedirectURIs),
 		},
 	})
 }
@@ -297,9 +352,42 @@ func (h *AdminHandler) UpdateApp(c *gin.Context) {
 	if req.RequiredPermissionLevel != "" {
 		app.RequiredPermissionLevel = req.RequiredPermissionLevel
 	}
+	if req.AccessMode != "" {
+		if !req.AccessMode.Valid() {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "invalid access_mode",
+			})
+			return
+		}
+		app.AccessMode = req.AccessMode
+	}
 	if req.IsActive != nil {
 		app.IsActive = *req.IsActive
 	}
+	if req.SingleUseNKeys != nil {
+		app.SingleUseNKeys = *req.SingleUseNKeys
+	}
+	if req.RedirectURIs != nil {
+		if err := validateRedirectURIs(*req.RedirectURIs); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": err.Error(),
+			})
+			return
+		}
+		app.RedirectURIs = encodeStringList(*req.RedirectURIs)
+	}
+	if req.PostLogoutRedirectURIs != nil {
+		if err := validateRedirectURIs(*req.PostLogoutRedirectURIs); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": err.Error(),
+			})
+			return
+		}
+		app.PostLogoutRedirectURIs = encodeStringList(*req.PostLogoutRedirectURIs)
+	}
 
 	if err := h.db.Save(&app).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -346,7 +434,7 @@ func (h *AdminHandler) DeleteApp(c *gin.Context) {
 		ActionType: "DELETE_APP",
 		TargetType: "APP",
 		TargetID:   appID,
-		OperatorID: operatorID.(uint),
+		OperatorID: models.AuditOperator(operatorID.(uint)),
 		IPAddress:  c.ClientIP(),
 		UserAgent:  c.GetHeader("User-Agent"),
 		Details:    fmt.Sprintf("Deleted app: %s", app.Name),
@@ -393,7 +481,7 @@ func (h *AdminHandler) ToggleAppStatus(c *gin.Context) {
 		ActionType: "TOGGLE_APP_STATUS",
 		TargetType: "APP",
 		TargetID:   appID,
-		OperatorID: operatorID.(uint),
+		OperatorID: models.AuditOperator(operatorID.(uint)),
 		IPAddress:  c.ClientIP(),
 		UserAgent:  c.GetHeader("User-Agent"),
 		Details:    fmt.Sprintf("App %s status changed to: %s", app.Name, status),
@@ -578,7 +666,12 @@ func (h *AdminHandler) UpdateUser(c *gin.Context) {
 		}
 		user.Username = req.Username
 	}
+	passwordChanged := false
 	if req.Password != "" {
+		if err := validateNewPassword(h.db, h.cfg, &user, req.Password); err != nil {
+			respondPasswordError(c, err)
+			return
+		}
 		hashedPassword, err := auth.HashPassword(req.Password)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -588,7 +681,9 @@ func (h *AdminHandler) UpdateUser(c *gin.Context) {
 			return
 		}
 		user.PasswordHash = hashedPassword
+		passwordChanged = true
 	}
+	statusChanged := false
 	if req.Status != "" {
 		operatorID, _ := c.Get("user_id")
 
@@ -601,6 +696,7 @@ func (h *AdminHandler) UpdateUser(c *gin.Context) {
 			return
 		}
 
+		statusChanged = user.Status != req.Status
 		user.Status = req.Status
 	}
 	if req.Phone != "" {
@@ -617,6 +713,55 @@ func (h *AdminHandler) UpdateUser(c *gin.Context) {
 		})
 		return
 	}
+	middleware.InvalidateUser(user.ID)
+
+	if passwordChanged {
+		recordPasswordHistory(h.db, h.cfg, user.ID, user.PasswordHash)
+	}
+
+	// A role change or disable must not leave tokens with the old status usable,
+	// and a password reset by an admin signs the user out everywhere
+	var revokeErr error
+	switch {
+	case statusChanged:
+		revokeErr = h.revokeSessions(c, &user, fmt.Sprintf("Status changed to %s", user.Status))
+	case passwordChanged:
+		revokeErr = h.revokeSessions(c, &user, "Password reset by admin")
+	}
+	if revokeErr != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to revoke sessions",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
+
+// RevokeUserSessions revokes all sessions and tokens of a user (admin only)
+func (h *AdminHandler) RevokeUserSessions(c *gin.Context) {
+	userID := c.Param("user_id")
+
+	var user models.User
+	if err := h.db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "user not found",
+		})
+		return
+	}
+
+	if err := h.revokeSessions(c, &user, "Revoked by admin"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to revoke sessions",
+		})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
@@ -624,6 +769,158 @@ func (h *AdminHandler) UpdateUser(c *gin.Context) {
 	})
 }
 
+// ResetUserTOTP removes a user's 2FA enrollment so they can enroll again (admin only)
+func (h *AdminHandler) ResetUserTOTP(c *gin.Context) {
+	userID := c.Param("user_id")
+	operatorID, _ := c.Get("user_id")
+
+	var user models.User
+	if err := h.db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "user not found",
+		})
+		return
+	}
+
+	if err := clearTOTP(h.db, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to reset two-factor authentication",
+		})
+		return
+	}
+	middleware.InvalidateUser(user.ID)
+
+	// Create audit log
+	auditLog := models.AuditLog{
+		ActionType: "RESET_2FA",
+		TargetType: "USER",
+		TargetID:   userID,
+		OperatorID: models.AuditOperator(operatorID.(uint)),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("Reset two-factor authentication for user: %s", user.Username),
+	}
+	h.db.Create(&auditLog)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
+
+// UnlockLoginRequest represents a request to clear a login lockout
+type UnlockLoginRequest struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+}
+
+// ListLockouts returns usernames and client IPs that are currently locked out (admin only)
+func (h *AdminHandler) ListLockouts(c *gin.Context) {
+	var throttles []models.LoginThrottle
+	if err := h.db.Where("locked_until > ?", time.Now()).Order("locked_until DESC").Find(&throttles).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to fetch lockouts",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    throttles,
+	})
+}
+
+// UnlockLogin clears failed login tracking for a username and/or client IP (admin only)
+func (h *AdminHandler) UnlockLogin(c *gin.Context) {
+	var req UnlockLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Username == "" && req.IP == "") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
+		})
+		return
+	}
+
+	if req.Username != "" {
+		h.unlock(c, usernameThrottleKey(req.Username))
+	}
+	if req.IP != "" {
+		h.unlock(c, ipThrottleKey(req.IP))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
+
+// UnlockUser clears failed login tracking for a user (admin only)
+func (h *AdminHandler) UnlockUser(c *gin.Context) {
+	userID := c.Param("user_id")
+
+	var user models.User
+	if err := h.db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "user not found",
+		})
+		return
+	}
+
+	h.unlock(c, usernameThrottleKey(user.Username))
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
+
+// unlock removes a login throttle entry and records an audit log
+func (h *AdminHandler) unlock(c *gin.Context, key string) {
+	operatorID, _ := c.Get("user_id")
+
+	resetLoginFailures(h.db, key)
+
+	auditLog := models.AuditLog{
+		ActionType: "UNLOCK_LOGIN",
+		TargetType: "LOGIN_THROTTLE",
+		TargetID:   key,
+		OperatorID: models.AuditOperator(operatorID.(uint)),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("Cleared failed login tracking for %s", key),
+	}
+	h.db.Create(&auditLog)
+}
+
+// revokeSessions revokes all sessions and NKeys of a user and records an audit log
+func (h *AdminHandler) revokeSessions(c *gin.Context, user *models.User, reason string) error {
+	if err := revokeUserSessions(h.db, user.ID); err != nil {
+		return err
+	}
+	if _, err := revokeUserNKeys(h.db, user.ID); err != nil {
+		return err
+	}
+
+	operatorID, _ := c.Get("user_id")
+	auditLog := models.AuditLog{
+		ActionType: "REVOKE_USER_SESSIONS",
+		TargetType: "USER",
+		TargetID:   fmt.Sprintf("%d", user.ID),
+		OperatorID: models.AuditOperator(operatorID.(uint)),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("Revoked all sessions and NKeys of user %s: %s", user.Username, reason),
+	}
+	h.db.Create(&auditLog)
+
+	return nil
+}
+
 // DeleteUser deletes a user (admin only)
 func (h *AdminHandler) DeleteUser(c *gin.Context) {
 	userID := c.Param("user_id")
@@ -648,6 +945,16 @@ func (h *AdminHandler) DeleteUser(c *gin.Context) {
 	}
 
 	// Use soft delete
+	// Sessions are revoked first so a failure leaves the user in place rather than
+	// deleted with live tokens
+	if err := h.revokeSessions(c, &user, "User deleted"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to revoke sessions",
+		})
+		return
+	}
+
 	if err := h.db.Delete(&user).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    500,
@@ -655,13 +962,14 @@ func (h *AdminHandler) DeleteUser(c *gin.Context) {
 		})
 		return
 	}
+	middleware.InvalidateUser(user.ID)
 
 	// Create audit log
 	auditLog := models.AuditLog{
 		ActionType: "DELETE_USER",
 		TargetType: "USER",
 		TargetID:   userID,
-		OperatorID: operatorID.(uint),
+		OperatorID: models.AuditOperator(operatorID.(uint)),
 		IPAddress:  c.ClientIP(),
 		UserAgent:  c.GetHeader("User-Agent"),
 		Details:    fmt.Sprintf("Deleted user: %s", user.Username),
@@ -710,7 +1018,7 @@ func (h *AdminHandler) DeleteInviteCode(c *gin.Context) {
 		ActionType: "DELETE_INVITE_CODE",
 		TargetType: "INVITE_CODE",
 		TargetID:   inviteCode,
-		OperatorID: operatorID.(uint),
+		OperatorID: models.AuditOperator(operatorID.(uint)),
 		IPAddress:  c.ClientIP(),
 		UserAgent:  c.GetHeader("User-Agent"),
 		Details:    fmt.Sprintf("Deleted invite code: %s", inviteCode),
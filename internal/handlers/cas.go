@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"tounetcore/internal/auth"
+	"tounetcore/internal/config"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// casTicketPrefix marks service tickets, which are single-use NKeys bound to a service URL
+const casTicketPrefix = "ST-"
+
+// CAS validation failure codes
+const (
+	casInvalidRequest = "INVALID_REQUEST"
+	casInvalidTicket  = "INVALID_TICKET"
+	casInvalidService = "INVALID_SERVICE"
+	casInternalError  = "INTERNAL_ERROR"
+)
+
+// casServiceResponse is the XML body of a CAS validation response
+type casServiceResponse struct {
+	XMLName xml.Name        `xml:"cas:serviceResponse"`
+	XMLNS   string          `xml:"xmlns:cas,attr"`
+	Success *casAuthSuccess `xml:"cas:authenticationSuccess,omitempty"`
+	Failure *casAuthFailure `xml:"cas:authenticationFailure,omitempty"`
+}
+
+type casAuthSuccess struct {
+	User       string        `xml:"cas:user"`
+	Attributes casAttributes `xml:"cas:attributes"`
+}
+
+type casAttributes struct {
+	Username string `xml:"cas:username"`
+	Role     string `xml:"cas:role"`
+	UserID   uint   `xml:"cas:userId"`
+}
+
+type casAuthFailure struct {
+	Code    string `xml:"code,attr"`
+	Message string `xml:",chardata"`
+}
+
+// CASHandler implements the CAS protocol on top of NKeys. Services are matched to apps
+// by App.URL, and service tickets are single-use NKeys for that app.
+type CASHandler struct {
+	db  *gorm.DB
+	cfg *config.Config
+	sso *SSOHandler
+}
+
+func NewCASHandler(db *gorm.DB, cfg *config.Config, keys *auth.KeySet) *CASHandler {
+	return &CASHandler{db: db, cfg: cfg, sso: NewSSOHandler(db, cfg, keys)}
+}
+
+// Login issues a service ticket from the SSO session and redirects back to the service.
+// Users without a session are sent to the SSO login page, or with gateway=true straight
+// back to the service without a ticket.
+func (h *CASHandler) Login(c *gin.Context) {
+	service := c.Query("service")
+	if service == "" {
+		c.Redirect(http.StatusFound, ssoLoginPath)
+		return
+	}
+
+	app := h.serviceApp(service)
+	if app == nil || !app.IsActive || !h.sso.allowedRedirect(service) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "unknown service",
+		})
+		return
+	}
+
+	user := sessionUser(c, h.db, h.cfg, h.sso.keys)
+	if user == nil {
+		if c.Query("gateway") == "true" {
+			c.Redirect(http.StatusFound, service)
+			return
+		}
+		c.Redirect(http.StatusFound, withQuery(ssoLoginPath, url.Values{"rd": {c.Request.URL.RequestURI()}}))
+		return
+	}
+
+	nkey, _, nkeyErr := issueNKey(h.db, h.cfg, user, []string{app.AppID}, c.ClientIP(), true, false)
+	if nkeyErr != nil {
+		c.JSON(nkeyErr.status, gin.H{
+			"code":    nkeyErr.status,
+			"message": nkeyErr.message,
+		})
+		return
+	}
+	if err := h.db.Model(&models.NKey{}).Where("key_value = ?", nkey).Update("service", service).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to store ticket",
+		})
+		return
+	}
+
+	auditLog := models.AuditLog{
+		ActionType: "CAS_LOGIN",
+		TargetType: "APP",
+		TargetID:   app.AppID,
+		OperatorID: models.AuditOperator(user.ID),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("User %s was issued a CAS ticket for %s", user.Username, service),
+	}
+	h.db.Create(&auditLog)
+
+	c.Redirect(http.StatusFound, withQuery(service, url.Values{"ticket": {casTicketPrefix + nkey}}))
+}
+
+// ServiceValidate validates a service ticket for the service it was issued for. It backs
+// both /cas/serviceValidate (CAS 2.0) and /cas/p3/serviceValidate (CAS 3.0), which
+// differ only in CAS 2.0 clients ignoring the attributes.
+func (h *CASHandler) ServiceValidate(c *gin.Context) {
+	service := c.Query("service")
+	ticket := c.Query("ticket")
+	if service == "" || ticket == "" {
+		h.fail(c, casInvalidRequest, "service and ticket are required")
+		return
+	}
+	if !strings.HasPrefix(ticket, casTicketPrefix) {
+		h.fail(c, casInvalidTicket, "ticket "+ticket+" not recognized")
+		return
+	}
+
+	app := h.serviceApp(service)
+	if app == nil || !app.IsActive {
+		h.fail(c, casInvalidService, "service "+service+" is not registered")
+		return
+	}
+
+	// Validation consumes the ticket, so a failed attempt cannot be retried
+	nkey, nkeyErr := checkNKey(h.db, h.cfg, strings.TrimPrefix(ticket, casTicketPrefix), app.AppID, "")
+	if nkeyErr != nil {
+		switch nkeyErr.reason {
+		case denyAppNotInNKey:
+			h.fail(c, casInvalidService, "ticket was not issued for service "+service)
+		case denyInternal:
+			h.fail(c, casInternalError, nkeyErr.message)
+		case denyInvalidNKey, denyNKeyExpired, denyNKeyRevoked, denyNKeyUsed:
+			h.fail(c, casInvalidTicket, "ticket "+ticket+" not recognized")
+		default:
+			h.fail(c, casInvalidTicket, "ticket "+ticket+" rejected: "+nkeyErr.message)
+		}
+		return
+	}
+	if nkey.Service != service {
+		h.fail(c, casInvalidService, "ticket was not issued for service "+service)
+		return
+	}
+
+	h.respond(c, casServiceResponse{Success: &casAuthSuccess{
+		User: nkey.User.Username,
+		Attributes: casAttributes{
+			Username: nkey.User.Username,
+			Role:     string(nkey.User.Status),
+			UserID:   nkey.User.ID,
+		},
+	}})
+}
+
+// Logout ends the SSO session and redirects to the service when it is an allowed target
+func (h *CASHandler) Logout(c *gin.Context) {
+	h.sso.endSession(c)
+
+	if service := c.Query("service"); h.sso.allowedRedirect(service) {
+		c.Redirect(http.StatusFound, service)
+		return
+	}
+	c.Redirect(http.StatusFound, ssoLoginPath)
+}
+
+// serviceApp returns the app whose URL matches a service URL, or nil
+func (h *CASHandler) serviceApp(service string) *models.App {
+	u, err := url.Parse(service)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	return findAppByURL(h.db, u.Host, u.RequestURI())
+}
+
+// fail writes a CAS authentication failure
+func (h *CASHandler) fail(c *gin.Context, code, message string) {
+	h.respond(c, casServiceResponse{Failure: &casAuthFailure{Code: code, Message: message}})
+}
+
+// respond writes a CAS service response. CAS reports failures in the body, so the status is always 200.
+func (h *CASHandler) respond(c *gin.Context, response casServiceResponse) {
+	response.XMLNS = "http://www.yale.edu/tp/cas"
+	c.Header("Cache-Control", "no-store")
+	c.XML(http.StatusOK, response)
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"tounetcore/internal/auth"
+	"tounetcore/internal/config"
+	"tounetcore/internal/middleware"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// nkeyCookieName is the cookie the browser flow stores NKeys in
+const nkeyCookieName = "nkey"
+
+// ForwardAuthHandler answers nginx auth_request and Traefik ForwardAuth subrequests
+type ForwardAuthHandler struct {
+	db   *gorm.DB
+	cfg  *config.Config
+	keys *auth.KeySet
+}
+
+func NewForwardAuthHandler(db *gorm.DB, cfg *config.Config, keys *auth.KeySet) *ForwardAuthHandler {
+	return &ForwardAuthHandler{db: db, cfg: cfg, keys: keys}
+}
+
+// ForwardAuth authorizes the request a reverse proxy is about to forward. The app is
+// found by matching X-Forwarded-Host and X-Forwarded-Uri against App.URL, and the user
+// by the session cookie or an NKey. Allowed requests get 200 with identity headers.
+func (h *ForwardAuthHandler) ForwardAuth(c *gin.Context) {
+	host := c.GetHeader("X-Forwarded-Host")
+	uri := c.GetHeader("X-Forwarded-Uri")
+	if host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "X-Forwarded-Host header required",
+		})
+		return
+	}
+	if uri == "" {
+		uri = "/"
+	}
+
+	app := findAppByURL(h.db, host, uri)
+	if app == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "no app matches the forwarded host",
+		})
+		return
+	}
+	if !app.IsActive {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code":    403,
+			"message": "app is inactive",
+		})
+		return
+	}
+
+	user, message := requestUser(c, h.db, h.cfg, h.keys, app.AppID)
+	if user == nil {
+		h.deny(c, http.StatusUnauthorized, message, host, uri)
+		return
+	}
+	if !userHasAppPermission(h.db, user.ID, user.Status, app) {
+		h.deny(c, http.StatusForbidden, "no permission for app", host, uri)
+		return
+	}
+
+	setIdentityHeaders(c.Writer.Header(), user, app.AppID)
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
+
+// deny rejects the request with a link back to the login page. Proxies that pass the
+// response through to the browser can add ?redirect=true to get a 302 instead of a 401.
+func (h *ForwardAuthHandler) deny(c *gin.Context, status int, message, host, uri string) {
+	proto := c.GetHeader("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "https"
+	}
+	loginURL := withQuery(h.cfg.ForwardAuthLoginURL, url.Values{"rd": {fmt.Sprintf("%s://%s%s", proto, host, uri)}})
+
+	if status == http.StatusUnauthorized && c.Query("redirect") == "true" {
+		c.Redirect(http.StatusFound, loginURL)
+		return
+	}
+
+	c.Header("Location", loginURL)
+	c.JSON(status, gin.H{
+		"code":    status,
+		"message": message,
+		"data":    gin.H{"login_url": loginURL},
+	})
+}
+
+// requestUser identifies the user from the session cookie, or else from an NKey for the app
+// in the nkey cookie or a Bearer header. It returns the reason when no user is found.
+// A page load makes many requests, so NKeys are checked without being claimed or counted;
+// single-use NKeys are refused since they could not be used up here.
+func requestUser(c *gin.Context, db *gorm.DB, cfg *config.Config, keys *auth.KeySet, appID string) (*models.User, string) {
+	if user := sessionUser(c, db, cfg, keys); user != nil {
+		return user, ""
+	}
+
+	value, _ := c.Cookie(nkeyCookieName)
+	if value == "" {
+		value = bearerToken(c.Request)
+	}
+	if value == "" {
+		return nil, "authentication required"
+	}
+
+	nkey, app, _, nkeyErr := inspectNKey(db, cfg, value, appID, c.ClientIP())
+	if nkeyErr != nil {
+		return nil, nkeyErr.message
+	}
+	if nkey.SingleUse || app.SingleUseNKeys {
+		return nil, "single-use nkeys must be validated by the app"
+	}
+	return &nkey.User, ""
+}
+
+// bearerToken returns the token in a request's Authorization: Bearer header, if any
+func bearerToken(r *http.Request) string {
+	if parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2); len(parts) == 2 && parts[0] == "Bearer" {
+		return parts[1]
+	}
+	return ""
+}
+
+// isNKey reports whether a token is an NKey issued by TouNetCore
+func isNKey(db *gorm.DB, token string) bool {
+	if auth.IsSignedNKey(token) {
+		return true
+	}
+	var count int64
+	db.Model(&models.NKey{}).Where("key_value = ?", token).Count(&count)
+	return count > 0
+}
+
+// sessionUser returns the user signed in through the session cookie, or nil. The cookie
+// holds an SSO session token, or an access token set by a frontend.
+func sessionUser(c *gin.Context, db *gorm.DB, cfg *config.Config, keys *auth.KeySet) *models.User {
+	token, err := c.Cookie(cfg.SessionCookieName)
+	if err != nil || token == "" {
+		return nil
+	}
+
+	claims, err := auth.ValidateSSOToken(token, keys)
+	if err != nil {
+		claims, err = auth.ValidateJWT(token, keys)
+	}
+	if err != nil || claims.SessionID == "" || middleware.IsTokenRevoked(db, claims) {
+		return nil
+	}
+
+	var user models.User
+	if err := db.First(&user, claims.UserID).Error; err != nil {
+		return nil
+	}
+	return &user
+}
+
+// setIdentityHeaders sets the headers that tell an app who the user is
+func setIdentityHeaders(header http.Header, user *models.User, appID string) {
+	header.Set("X-Auth-User", user.Username)
+	header.Set("X-Auth-User-Id", fmt.Sprintf("%d", user.ID))
+	header.Set("X-Auth-Role", string(user.Status))
+	header.Set("X-Auth-App", appID)
+}
+
+// findAppByURL returns the app whose URL matches the host and path. When several
+// apps share a host, the one with the longest matching path wins.
+func findAppByURL(db *gorm.DB, host, uri string) *models.App {
+	var apps []models.App
+	if err := db.Where("url <> ''").Find(&apps).Error; err != nil {
+		return nil
+	}
+
+	requestPath := uri
+	if u, err := url.ParseRequestURI(uri); err == nil {
+		requestPath = u.Path
+	}
+
+	var match *models.App
+	matchLen := -1
+	for i := range apps {
+		u, err := url.Parse(apps[i].URL)
+		if err != nil || !sameHost(u.Host, host) {
+			continue
+		}
+		prefix := strings.TrimSuffix(u.Path, "/")
+		if prefix != "" && requestPath != prefix && !strings.HasPrefix(requestPath, prefix+"/") {
+			continue
+		}
+		if len(prefix) > matchLen {
+			match, matchLen = &apps[i], len(prefix)
+		}
+	}
+	return match
+}
+
+// sameHost compares two hosts, ignoring case and default HTTP ports
+func sameHost(a, b string) bool {
+	trim := func(host string) string {
+		host = strings.ToLower(host)
+		host = strings.TrimSuffix(host, ":443")
+		return strings.TrimSuffix(host, ":80")
+	}
+	return a != "" && trim(a) == trim(b)
+}
@@ -0,0 +1,481 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// AppGrantRequest sets per-user app grant fields. Omitted fields are left unchanged,
+// or take their defaults on new grants; null clears valid_until and custom_limit.
+type AppGrantRequest struct {
+	Enabled     *bool           `json:"enabled"`
+	ValidUntil  json.RawMessage `json:"valid_until"`
+	CustomLimit json.RawMessage `json:"custom_limit"`
+}
+
+// UserAppGrantsRequest sets grants for one user on several apps
+type UserAppGrantsRequest struct {
+	AppIDs []string `json:"app_ids" binding:"required"`
+	AppGrantRequest
+}
+
+// AppUserGrantsRequest sets grants for several users on one app
+type AppUserGrantsRequest struct {
+	UserIDs []uint `json:"user_ids" binding:"required"`
+	AppGrantRequest
+}
+
+// DeleteUserAppGrantsRequest removes grants for one user on several apps
+type DeleteUserAppGrantsRequest struct {
+	AppIDs []string `json:"app_ids" binding:"required"`
+}
+
+// DeleteAppUserGrantsRequest removes grants for several users on one app
+type DeleteAppUserGrantsRequest struct {
+	UserIDs []uint `json:"user_ids" binding:"required"`
+}
+
+// grantTarget is a user and app pair a grant change applies to
+type grantTarget struct {
+	user *models.User
+	app  *models.App
+}
+
+// ListUserGrants lists a user's app grants (admin only)
+func (h *AdminHandler) ListUserGrants(c *gin.Context) {
+	user, ok := h.grantUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+
+	var grants []models.UserAllowedApp
+	if err := h.db.Where("user_id = ?", user.ID).Order("app_id").Find(&grants).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to fetch grants",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"user_id": user.ID,
+			"grants":  grantList(grants),
+		},
+	})
+}
+
+// ListAppGrants lists the user grants of an app (admin only)
+func (h *AdminHandler) ListAppGrants(c *gin.Context) {
+	app, ok := h.grantApp(c, c.Param("app_id"))
+	if !ok {
+		return
+	}
+
+	var grants []models.UserAllowedApp
+	if err := h.db.Preload("User").Where("app_id = ?", app.AppID).Order("user_id").Find(&grants).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to fetch grants",
+		})
+		return
+	}
+
+	list := grantList(grants)
+	for i, grant := range grants {
+		list[i]["username"] = grant.User.Username
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"app_id": app.AppID,
+			"grants": list,
+		},
+	})
+}
+
+// SetUserGrant creates or changes a user's grant for one app (admin only)
+func (h *AdminHandler) SetUserGrant(c *gin.Context) {
+	var req AppGrantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
+		})
+		return
+	}
+
+	user, ok := h.grantUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+	app, ok := h.grantApp(c, c.Param("app_id"))
+	if !ok {
+		return
+	}
+
+	h.setGrants(c, []grantTarget{{user, app}}, &req)
+}
+
+// SetUserGrants creates or changes a user's grants for several apps (admin only)
+func (h *AdminHandler) SetUserGrants(c *gin.Context) {
+	var req UserAppGrantsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
+		})
+		return
+	}
+
+	user, ok := h.grantUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+	var targets []grantTarget
+	for _, appID := range req.AppIDs {
+		app, ok := h.grantApp(c, appID)
+		if !ok {
+			return
+		}
+		targets = append(targets, grantTarget{user, app})
+	}
+
+	h.setGrants(c, targets, &req.AppGrantRequest)
+}
+
+// SetAppGrants creates or changes the grants of several users for an app (admin only)
+func (h *AdminHandler) SetAppGrants(c *gin.Context) {
+	var req AppUserGrantsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
+		})
+		return
+	}
+
+	app, ok := h.grantApp(c, c.Param("app_id"))
+	if !ok {
+		return
+	}
+	var targets []grantTarget
+	for _, userID := range req.UserIDs {
+		user, ok := h.grantUser(c, strconv.FormatUint(uint64(userID), 10))
+		if !ok {
+			return
+		}
+		targets = append(targets, grantTarget{user, app})
+	}
+
+	h.setGrants(c, targets, &req.AppGrantRequest)
+}
+
+// DeleteUserGrant removes a user's grant for one app, so the role default applies again (admin only)
+func (h *AdminHandler) DeleteUserGrant(c *gin.Context) {
+	user, ok := h.grantUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+	app, ok := h.grantApp(c, c.Param("app_id"))
+	if !ok {
+		return
+	}
+
+	h.deleteGrants(c, []grantTarget{{user, app}})
+}
+
+// DeleteUserGrants removes a user's grants for several apps (admin only)
+func (h *AdminHandler) DeleteUserGrants(c *gin.Context) {
+	var req DeleteUserAppGrantsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
+		})
+		return
+	}
+
+	user, ok := h.grantUser(c, c.Param("user_id"))
+	if !ok {
+		return
+	}
+	var targets []grantTarget
+	for _, appID := range req.AppIDs {
+		app, ok := h.grantApp(c, appID)
+		if !ok {
+			return
+		}
+		targets = append(targets, grantTarget{user, app})
+	}
+
+	h.deleteGrants(c, targets)
+}
+
+// DeleteAppGrants removes the grants of several users for an app (admin only)
+func (h *AdminHandler) DeleteAppGrants(c *gin.Context) {
+	var req DeleteAppUserGrantsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
+		})
+		return
+	}
+
+	app, ok := h.grantApp(c, c.Param("app_id"))
+	if !ok {
+		return
+	}
+	var targets []grantTarget
+	for _, userID := range req.UserIDs {
+		user, ok := h.grantUser(c, strconv.FormatUint(uint64(userID), 10))
+		if !ok {
+			return
+		}
+		targets = append(targets, grantTarget{user, app})
+	}
+
+	h.deleteGrants(c, targets)
+}
+
+// setGrants applies a grant request to every target in one transaction and audits each change
+func (h *AdminHandler) setGrants(c *gin.Context, targets []grantTarget, req *AppGrantRequest) {
+	operatorID, _ := c.Get("user_id")
+
+	var grants []models.UserAllowedApp
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		for _, target := range targets {
+			var grant models.UserAllowedApp
+			err := tx.Where("user_id = ? AND app_id = ?", target.user.ID, target.app.AppID).First(&grant).Error
+			created := errors.Is(err, gorm.ErrRecordNotFound)
+			if err != nil && !created {
+				return err
+			}
+			if created {
+				grant = models.UserAllowedApp{UserID: target.user.ID, AppID: target.app.AppID, Enabled: true}
+			}
+
+			if err := req.apply(&grant); err != nil {
+				return err
+			}
+			if created {
+				// GORM inserts the column default for enabled=false, so it is written separately
+				enabled := grant.Enabled
+				if err := tx.Create(&grant).Error; err != nil {
+					return err
+				}
+				if err := tx.Model(&grant).Update("enabled", enabled).Error; err != nil {
+					return err
+				}
+			} else if err := tx.Save(&grant).Error; err != nil {
+				return err
+			}
+
+			action := "UPDATE_APP_GRANT"
+			if created {
+				action = "GRANT_APP_ACCESS"
+			}
+			auditLog := models.AuditLog{
+				ActionType: action,
+				TargetType: "USER",
+				TargetID:   fmt.Sprintf("%d", target.user.ID),
+				OperatorID: models.AuditOperator(operatorID.(uint)),
+				IPAddress:  c.ClientIP(),
+				UserAgent:  c.GetHeader("User-Agent"),
+				Details:    fmt.Sprintf("App %s grant for user %s: %s", target.app.AppID, target.user.Username, describeGrant(&grant)),
+			}
+			if err := tx.Create(&auditLog).Error; err != nil {
+				return err
+			}
+
+			grants = append(grants, grant)
+		}
+		return nil
+	})
+
+	var invalid *grantFieldError
+	if errors.As(err, &invalid) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": invalid.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to save grants",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"grants": grantList(grants),
+		},
+	})
+}
+
+// deleteGrants removes the grants of every target in one transaction and audits each removal
+func (h *AdminHandler) deleteGrants(c *gin.Context, targets []grantTarget) {
+	operatorID, _ := c.Get("user_id")
+
+	deleted := 0
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		for _, target := range targets {
+			result := tx.Where("user_id = ? AND app_id = ?", target.user.ID, target.app.AppID).Delete(&models.UserAllowedApp{})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				continue
+			}
+			deleted++
+
+			auditLog := models.AuditLog{
+				ActionType: "REVOKE_APP_GRANT",
+				TargetType: "USER",
+				TargetID:   fmt.Sprintf("%d", target.user.ID),
+				OperatorID: models.AuditOperator(operatorID.(uint)),
+				IPAddress:  c.ClientIP(),
+				UserAgent:  c.GetHeader("User-Agent"),
+				Details:    fmt.Sprintf("Removed app %s grant for user %s", target.app.AppID, target.user.Username),
+			}
+			if err := tx.Create(&auditLog).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to delete grants",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"deleted": deleted,
+		},
+	})
+}
+
+// grantUser loads the user a grant request refers to, responding 404 when it does not exist
+func (h *AdminHandler) grantUser(c *gin.Context, userID string) (*models.User, bool) {
+	var user models.User
+	if err := h.db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "user not found: " + userID,
+		})
+		return nil, false
+	}
+	return &user, true
+}
+
+// grantApp loads the app a grant request refers to, responding 404 when it does not exist
+func (h *AdminHandler) grantApp(c *gin.Context, appID string) (*models.App, bool) {
+	var app models.App
+	if err := h.db.Where("app_id = ?", appID).First(&app).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "app not found: " + appID,
+		})
+		return nil, false
+	}
+	return &app, true
+}
+
+// grantFieldError is an invalid field value in a grant request
+type grantFieldError struct {
+	field string
+}
+
+func (e *grantFieldError) Error() string {
+	return "invalid " + e.field
+}
+
+// apply copies the fields present in the request onto a grant
+func (r *AppGrantRequest) apply(grant *models.UserAllowedApp) error {
+	if r.Enabled != nil {
+		grant.Enabled = *r.Enabled
+	}
+
+	if len(r.ValidUntil) > 0 {
+		var validUntil *time.Time
+		if err := json.Unmarshal(r.ValidUntil, &validUntil); err != nil {
+			return &grantFieldError{"valid_until"}
+		}
+		grant.ValidUntil = validUntil
+	}
+
+	if len(r.CustomLimit) > 0 {
+		if bytes.Equal(r.CustomLimit, []byte("null")) {
+			grant.CustomLimit = ""
+		} else {
+			if _, err := parseCustomLimit(r.CustomLimit); err != nil {
+				return &grantFieldError{"custom_limit: " + err.Error()}
+			}
+			var compact bytes.Buffer
+			json.Compact(&compact, r.CustomLimit)
+			grant.CustomLimit = compact.String()
+		}
+	}
+
+	return nil
+}
+
+// grantList builds the response entries for grants
+func grantList(grants []models.UserAllowedApp) []gin.H {
+	list := make([]gin.H, 0, len(grants))
+	for _, grant := range grants {
+		var customLimit interface{}
+		if grant.CustomLimit != "" {
+			customLimit = json.RawMessage(grant.CustomLimit)
+		}
+		list = append(list, gin.H{
+			"user_id":      grant.UserID,
+			"app_id":       grant.AppID,
+			"enabled":      grant.Enabled,
+			"valid_until":  grant.ValidUntil,
+			"custom_limit": customLimit,
+			"active":       grantActive(&grant),
+			"created_at":   grant.CreatedAt,
+			"updated_at":   grant.UpdatedAt,
+		})
+	}
+	return list
+}
+
+// describeGrant summarizes a grant's settings for the audit log
+func describeGrant(grant *models.UserAllowedApp) string {
+	parts := []string{fmt.Sprintf("enabled=%t", grant.Enabled)}
+	if grant.ValidUntil != nil {
+		parts = append(parts, "valid_until="+grant.ValidUntil.Format(time.RFC3339))
+	}
+	if grant.CustomLimit != "" {
+		parts = append(parts, "custom_limit="+grant.CustomLimit)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"tounetcore/internal/auth"
+	"tounetcore/internal/config"
+	"tounetcore/internal/database"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testPostgresDSNEnv names the variable holding a Postgres DSN for tests that also run
+// against Postgres. Each test gets its own schema, dropped when it ends.
+const testPostgresDSNEnv = "TEST_POSTGRES_DSN"
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestDB opens a migrated SQLite database in a temporary directory. Foreign keys are
+// enforced, as they are on Postgres.
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	dsn := filepath.Join(t.TempDir(), "test.db") + "?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=on"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	migrateTestDB(t, db)
+	return db
+}
+
+// newPostgresTestDB opens a migrated Postgres schema, or skips the test without a DSN
+func newPostgresTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	dsn := os.Getenv(testPostgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s not set", testPostgresDSNEnv)
+	}
+
+	admin, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open postgres: %v", err)
+	}
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	schema := "test_" + hex.EncodeToString(suffix)
+	if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if sqlDB, err := admin.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	db, err := gorm.Open(postgres.Open(dsn+separator+"search_path="+schema), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open postgres schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	migrateTestDB(t, db)
+	return db
+}
+
+func migrateTestDB(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	if err := database.RunMigrations(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+}
+
+// newTestConfig returns the default configuration with key files kept in a temporary directory
+func newTestConfig(t *testing.T) *config.Config {
+	t.Helper()
+
+	cfg := config.LoadConfig()
+	dir := t.TempDir()
+	cfg.Environment = "development"
+	cfg.JWTAlgorithm = "HS256"
+	cfg.JWTKeysDir = filepath.Join(dir, "jwt_keys")
+	cfg.NKeyFormat = auth.NKeyFormatOpaque
+	cfg.NKeySigningKeyFile = filepath.Join(dir, "nkey_signing_key.pem")
+	return cfg
+}
+
+// newTestKeys loads the JWT key set for a test configuration
+func newTestKeys(t *testing.T, cfg *config.Config) *auth.KeySet {
+	t.Helper()
+
+	keys, err := auth.LoadKeySet(cfg)
+	if err != nil {
+		t.Fatalf("load keys: %v", err)
+	}
+	return keys
+}
+
+// createTestUser stores a user with the given role
+func createTestUser(t *testing.T, db *gorm.DB, username string, status models.UserStatus) *models.User {
+	t.Helper()
+
+	hash, err := auth.HashPassword("Passw0rd-" + username)
+	if err != nil {
+		t.Fatalf("hash password: %v", err)
+	}
+	user := models.User{Username: username, PasswordHash: hash, Status: status}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	return &user
+}
+
+// createTestApp stores an active app open to users
+func createTestApp(t *testing.T, db *gorm.DB, appID string) *models.App {
+	t.Helper()
+
+	app := models.App{
+		AppID:                   appID,
+		Name:                    appID,
+		SecretKey:               "unused",
+		RequiredPermissionLevel: models.StatusUser,
+		AccessMode:              models.AccessRoleBased,
+		IsActive:                true,
+	}
+	if err := db.Create(&app).Error; err != nil {
+		t.Fatalf("create app: %v", err)
+	}
+	return &app
+}
+
+// asUser stands in for AuthMiddleware, marking the request as the given user's
+func asUser(user *models.User) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("user_id", user.ID)
+		c.Set("username", user.Username)
+		c.Set("user_status", user.Status)
+		c.Set("mfa_enabled", user.MFAEnabled())
+		c.Next()
+	}
+}
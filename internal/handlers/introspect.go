@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"tounetcore/internal/auth"
+	"tounetcore/internal/middleware"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Introspect reports whether a token is active (RFC 7662). It accepts NKeys, TouNetCore
+// API access tokens, access tokens issued to the calling client and its refresh tokens.
+// Introspecting an NKey does not count as using it; apps that rely on single-use NKeys
+// must validate them instead.
+func (h *OIDCHandler) Introspect(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+
+	app, ok := h.authenticateClient(c)
+	if !ok {
+		return
+	}
+
+	token := c.PostForm("token")
+	if token == "" {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	inactive := gin.H{"active": false}
+
+	if isJWT(token) {
+		claims, user := h.activeAccessToken(token, app.AppID)
+		if claims == nil {
+			c.JSON(http.StatusOK, inactive)
+			return
+		}
+		result := tokenInfo("access_token", user, claims.ExpiresAt.Time, claims.IssuedAt.Time)
+		result["jti"] = claims.ID
+		if claims.ClientID != "" {
+			result["iss"] = claims.Issuer
+			result["aud"] = claims.ClientID
+			result["client_id"] = claims.ClientID
+			result["scope"] = claims.Scope
+		}
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	if nkey := h.findNKey(token, app.AppID); nkey != nil {
+		if !nkeyActive(h.db, nkey, app) {
+			c.JSON(http.StatusOK, inactive)
+			return
+		}
+		result := tokenInfo("nkey", &nkey.User, nkey.ExpiresAt, nkey.CreatedAt)
+		result["client_id"] = app.AppID
+		result["scope"] = strings.Join(decodeStringList(nkey.AppIDs), " ")
+		result["single_use"] = nkey.SingleUse || app.SingleUseNKeys
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	// Refresh tokens are only disclosed to the client they were issued to
+	var session models.Session
+	if err := h.db.Preload("User").Where("refresh_token_hash = ?", auth.HashToken(token)).First(&session).Error; err == nil &&
+		session.ClientID == app.AppID && session.User.ID != 0 && session.RevokedAt == nil && session.RotatedAt == nil && time.Now().Before(session.ExpiresAt) {
+		result := tokenInfo("refresh_token", &session.User, session.ExpiresAt, session.CreatedAt)
+		result["client_id"] = session.ClientID
+		result["scope"] = session.Scope
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	c.JSON(http.StatusOK, inactive)
+}
+
+// Revoke revokes a token on behalf of the client it belongs to (RFC 7009). Unknown
+// tokens are ignored as the RFC requires, so the response does not reveal them.
+func (h *OIDCHandler) Revoke(c *gin.Context) {
+	app, ok := h.authenticateClient(c)
+	if !ok {
+		return
+	}
+
+	token := c.PostForm("token")
+	if token == "" {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "token is required")
+		return
+	}
+
+	if isJWT(token) {
+		claims, err := auth.ValidateClientAccessToken(token, h.keys, h.cfg.OIDCIssuer)
+		if err != nil {
+			if _, err := auth.ValidateJWT(token, h.keys); err == nil {
+				oauthError(c, http.StatusBadRequest, "unauthorized_client", "the token was not issued to the client")
+				return
+			}
+			c.Status(http.StatusOK)
+			return
+		}
+		if claims.ClientID != app.AppID {
+			oauthError(c, http.StatusBadRequest, "unauthorized_client", "the token was not issued to the client")
+			return
+		}
+		if !middleware.IsTokenRevoked(h.db, claims) {
+			if err := revokeAccessToken(h.db, claims.ID, claims.UserID, claims.ExpiresAt.Time); err != nil {
+				oauthError(c, http.StatusServiceUnavailable, "temporarily_unavailable", "failed to revoke token")
+				return
+			}
+			h.auditRevoke(c, app, claims.UserID, "access token "+claims.ID)
+		}
+		c.Status(http.StatusOK)
+		return
+	}
+
+	if nkey := h.findNKey(token, app.AppID); nkey != nil {
+		// An NKey issued for several apps is not this app's alone to revoke
+		if appIDs := decodeStringList(nkey.AppIDs); len(appIDs) != 1 {
+			oauthError(c, http.StatusBadRequest, "unauthorized_client", "the nkey is shared with other apps")
+			return
+		}
+		if nkey.RevokedAt == nil {
+			if err := h.db.Model(nkey).Update("revoked_at", time.Now()).Error; err != nil {
+				oauthError(c, http.StatusServiceUnavailable, "temporarily_unavailable", "failed to revoke token")
+				return
+			}
+			h.auditRevoke(c, app, nkey.UserID, fmt.Sprintf("NKey %d", nkey.ID))
+		}
+		c.Status(http.StatusOK)
+		return
+	}
+
+	var session models.Session
+	if err := h.db.Where("refresh_token_hash = ?", auth.HashToken(token)).First(&session).Error; err == nil {
+		if session.ClientID != app.AppID {
+			oauthError(c, http.StatusBadRequest, "unauthorized_client", "the token was not issued to the client")
+			return
+		}
+		if session.RevokedAt == nil {
+			if err := revokeSessionFamily(h.db, session.FamilyID); err != nil {
+				oauthError(c, http.StatusServiceUnavailable, "temporarily_unavailable", "failed to revoke token")
+				return
+			}
+			h.auditRevoke(c, app, session.UserID, "session family "+session.FamilyID)
+		}
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// activeAccessToken returns the claims and live user of an active TouNetCore API access token,
+// or of an access token issued to the calling client. Client tokens of other clients, revoked
+// sessions and deleted or disabled users are not active.
+func (h *OIDCHandler) activeAccessToken(token, clientID string) (*auth.Claims, *models.User) {
+	claims, err := auth.ValidateJWT(token, h.keys)
+	if err != nil {
+		claims, err = auth.ValidateClientAccessToken(token, h.keys, h.cfg.OIDCIssuer)
+		if err != nil || claims.ClientID != clientID {
+			return nil, nil
+		}
+	}
+	if claims.SessionID == "" || middleware.IsTokenRevoked(h.db, claims) {
+		return nil, nil
+	}
+
+	var user models.User
+	if err := h.db.First(&user, claims.UserID).Error; err != nil || user.Status == models.StatusDisabledUser {
+		return nil, nil
+	}
+	return claims, &user
+}
+
+// findNKey looks up an NKey the app may use, or returns nil
+func (h *OIDCHandler) findNKey(token, appID string) *models.NKey {
+	var nkey models.NKey
+	if err := h.db.Preload("User").Where("key_value = ?", token).First(&nkey).Error; err != nil {
+		return nil
+	}
+
+	var appIDs []string
+	if err := json.Unmarshal([]byte(nkey.AppIDs), &appIDs); err != nil || !containsString(appIDs, appID) {
+		return nil
+	}
+	return &nkey
+}
+
+// nkeyActive reports whether an NKey would currently pass validation for the app
+func nkeyActive(db *gorm.DB, nkey *models.NKey, app *models.App) bool {
+	if nkey.RevokedAt != nil || time.Now().After(nkey.ExpiresAt) {
+		return false
+	}
+	return nkeyDenial(db, nkey, app) == nil
+}
+
+// tokenInfo builds the common fields of an active introspection response
+func tokenInfo(tokenType string, user *models.User, expiresAt, issuedAt time.Time) gin.H {
+	return gin.H{
+		"active":     true,
+		"token_type": tokenType,
+		"sub":        fmt.Sprintf("%d", user.ID),
+		"username":   user.Username,
+		"role":       user.Status,
+		"exp":        expiresAt.Unix(),
+		"iat":        issuedAt.Unix(),
+	}
+}
+
+// auditRevoke records a token revoked through the revocation endpoint
+func (h *OIDCHandler) auditRevoke(c *gin.Context, app *models.App, userID uint, what string) {
+	auditLog := models.AuditLog{
+		ActionType: "OAUTH_TOKEN_REVOKED",
+		TargetType: "APP",
+		TargetID:   app.AppID,
+		OperatorID: models.AuditOperator(userID),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("App %s revoked %s", app.AppID, what),
+	}
+	h.db.Create(&auditLog)
+}
+
+// isJWT reports whether a token looks like a JWT rather than an NKey or refresh token
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && !auth.IsSignedNKey(token)
+}
@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"net/http"
+	"tounetcore/internal/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+type KeysHandler struct {
+	keys *auth.KeySet
+}
+
+func NewKeysHandler(keys *auth.KeySet) *KeysHandler {
+	return &KeysHandler{keys: keys}
+}
+
+// JWKS publishes the public keys that verify access tokens as a standard JSON Web Key Set
+func (h *KeysHandler) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=60")
+	c.JSON(http.StatusOK, h.keys.JWKS())
+}
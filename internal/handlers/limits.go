@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezone limits parse the same on hosts without zoneinfo
+	"tounetcore/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Usage counter kinds for custom limits
+const (
+	usageNKeysHour      = "nkeys_hour"
+	usageNKeysDay       = "nkeys_day"
+	usageValidationsDay = "validations_day"
+)
+
+// CustomLimit is the schema of UserAllowedApp.CustomLimit. Zero or empty fields do not limit.
+type CustomLimit struct {
+	NKeysPerHour      int      `json:"nkeys_per_hour,omitempty"`
+	NKeysPerDay       int      `json:"nkeys_per_day,omitempty"`
+	ValidationsPerDay int      `json:"validations_per_day,omitempty"`
+	AllowedHours      []string `json:"allowed_hours,omitempty"` // "09-18", end exclusive; "22-06" wraps past midnight
+	AllowedCIDRs      []string `json:"allowed_cidrs,omitempty"`
+	Timezone          string   `json:"timezone,omitempty"` // IANA zone for allowed_hours and daily limits; server time when empty
+}
+
+// parseCustomLimit decodes and validates a custom limit. Unknown fields are rejected
+// so that misspelled limits are not silently ignored.
+func parseCustomLimit(data []byte) (*CustomLimit, error) {
+	var limit CustomLimit
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&limit); err != nil {
+		return nil, err
+	}
+
+	if limit.NKeysPerHour < 0 || limit.NKeysPerDay < 0 || limit.ValidationsPerDay < 0 {
+		return nil, errors.New("limits must not be negative")
+	}
+	for _, window := range limit.AllowedHours {
+		if _, _, err := parseHourWindow(window); err != nil {
+			return nil, err
+		}
+	}
+	for _, cidr := range limit.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", cidr)
+		}
+	}
+	if _, err := time.LoadLocation(limit.Timezone); err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", limit.Timezone)
+	}
+	return &limit, nil
+}
+
+// parseHourWindow parses an "HH-HH" window of hours of the day
+func parseHourWindow(window string) (int, int, error) {
+	parts := strings.SplitN(window, "-", 2)
+	if len(parts) == 2 {
+		start, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+		end, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err1 == nil && err2 == nil && start >= 0 && start <= 23 && end >= 0 && end <= 24 && start != end {
+			return start, end, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid hour window %q", window)
+}
+
+// grantLimit returns the custom limit of the user's grant for an app, or nil when there is none.
+// A limit that does not parse, such as one stored before limits were validated, denies
+// access until an administrator fixes it rather than leaving the grant unrestricted.
+func grantLimit(db *gorm.DB, userID uint, appID string) (*CustomLimit, *nkeyError) {
+	var grant models.UserAllowedApp
+	if err := db.Where("user_id = ? AND app_id = ?", userID, appID).First(&grant).Error; err != nil || grant.CustomLimit == "" {
+		return nil, nil
+	}
+
+	limit, err := parseCustomLimit([]byte(grant.CustomLimit))
+	if err != nil {
+		log.Printf("Invalid custom limit of user %d for app %s: %v", userID, appID, err)
+		return nil, &nkeyError{http.StatusForbidden, denyInvalidLimit, "access limit for app " + appID + " is invalid, contact an administrator"}
+	}
+	return limit, nil
+}
+
+// checkAccess enforces the time-of-day windows and source networks of a limit.
+// When networks are configured, an unknown (empty) clientIP is refused.
+func (l *CustomLimit) checkAccess(appID, clientIP string, now time.Time) *nkeyError {
+	if len(l.AllowedHours) > 0 {
+		hour := now.In(l.location()).Hour()
+		allowed := false
+		for _, window := range l.AllowedHours {
+			start, end, _ := parseHourWindow(window)
+			if (start < end && hour >= start && hour < end) || (start > end && (hour >= start || hour < end)) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &nkeyError{http.StatusForbidden, denyOutsideHours, "outside allowed hours for app: " + appID}
+		}
+	}
+
+	if len(l.AllowedCIDRs) > 0 {
+		ip := net.ParseIP(clientIP)
+		allowed := false
+		for _, cidr := range l.AllowedCIDRs {
+			if _, network, err := net.ParseCIDR(cidr); err == nil && ip != nil && network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &nkeyError{http.StatusForbidden, denyAddressNotAllowed, "address not allowed for app: " + appID}
+		}
+	}
+
+	return nil
+}
+
+// consumeNKeyQuota counts an NKey issued for the app against the hourly and daily limits
+func (l *CustomLimit) consumeNKeyQuota(db *gorm.DB, userID uint, appID string, now time.Time) *nkeyError {
+	if l.NKeysPerHour > 0 {
+		if err := consumeQuota(db, userID, appID, usageNKeysHour, now.Truncate(time.Hour), l.NKeysPerHour); err != nil {
+			return err.withMessage("hourly nkey limit reached for app: " + appID)
+		}
+	}
+	if l.NKeysPerDay > 0 {
+		if err := consumeQuota(db, userID, appID, usageNKeysDay, l.dayStart(now), l.NKeysPerDay); err != nil {
+			return err.withMessage("daily nkey limit reached for app: " + appID)
+		}
+	}
+	return nil
+}
+
+// consumeValidationQuota counts a successful validation against the daily limit
+func (l *CustomLimit) consumeValidationQuota(db *gorm.DB, userID uint, appID string, now time.Time) *nkeyError {
+	if l.ValidationsPerDay > 0 {
+		if err := consumeQuota(db, userID, appID, usageValidationsDay, l.dayStart(now), l.ValidationsPerDay); err != nil {
+			return err.withMessage("daily validation limit reached for app: " + appID)
+		}
+	}
+	return nil
+}
+
+// location returns the time zone the limit's hours and days are counted in
+func (l *CustomLimit) location() *time.Location {
+	if loc, err := time.LoadLocation(l.Timezone); err == nil && l.Timezone != "" {
+		return loc
+	}
+	return time.Local
+}
+
+// dayStart returns midnight of the current day in the limit's time zone
+func (l *CustomLimit) dayStart(now time.Time) time.Time {
+	local := now.In(l.location())
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location()).UTC()
+}
+
+// consumeQuota counts one use in the window and reports 429 once the count passes the limit.
+// Counters live in the database so instances sharing it enforce the limit together.
+func consumeQuota(db *gorm.DB, userID uint, appID, kind string, windowStart time.Time, limit int) *nkeyError {
+	windowStart = windowStart.UTC()
+
+	// Counters of earlier windows are no longer needed
+	db.Where("user_id = ? AND app_id = ? AND kind = ? AND window_start < ?", userID, appID, kind, windowStart).
+		Delete(&models.UsageCounter{})
+
+	// Atomic increment so concurrent requests are all counted
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "app_id"}, {Name: "kind"}, {Name: "window_start"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("usage_counters.count + 1")}),
+	}).Create(&models.UsageCounter{UserID: userID, AppID: appID, Kind: kind, WindowStart: windowStart, Count: 1}).Error
+	if err != nil {
+		return &nkeyError{http.StatusInternalServerError, denyInternal, "failed to record usage"}
+	}
+
+	var counter models.UsageCounter
+	if err := db.Where("user_id = ? AND app_id = ? AND kind = ? AND window_start = ?", userID, appID, kind, windowStart).
+		First(&counter).Error; err != nil {
+		return &nkeyError{http.StatusInternalServerError, denyInternal, "failed to record usage"}
+	}
+	if counter.Count > limit {
+		return &nkeyError{status: http.StatusTooManyRequests, reason: denyQuotaExceeded}
+	}
+	return nil
+}
+
+// withMessage fills in the message of a quota error; other errors keep their own
+func (e *nkeyError) withMessage(message string) *nkeyError {
+	if e.status == http.StatusTooManyRequests {
+		e.message = message
+	}
+	return e
+}
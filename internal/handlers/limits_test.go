@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tounetcore/internal/middleware"
+	"tounetcore/internal/models"
+)
+
+// allowed_cidrs is checked against the connection's address; a client cannot claim an
+// allowed address with X-Forwarded-For
+func TestAllowedCIDRsIgnoreForgedForwardedFor(t *testing.T) {
+	db := newTestDB(t)
+	cfg := newTestConfig(t)
+	user := createTestUser(t, db, "alice", models.StatusUser)
+	createTestApp(t, db, "office")
+	grant := models.UserAllowedApp{UserID: user.ID, AppID: "office", Enabled: true, CustomLimit: `{"allowed_cidrs":["198.51.100.0/24"]}`}
+	if err := db.Create(&grant).Error; err != nil {
+		t.Fatalf("create grant: %v", err)
+	}
+
+	r, err := middleware.NewEngine(cfg)
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+	h := NewNKeyHandler(db, cfg)
+	r.POST("/nkey/apply", asUser(user), h.ApplyNKey)
+
+	apply := func(forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodPost, "/nkey/apply", bytes.NewReader([]byte(`{"app_ids":["office"]}`)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if status := apply("198.51.100.7"); status != http.StatusForbidden {
+		t.Fatalf("forged allowed address: status %d, want 403", status)
+	}
+
+	// The same header from a trusted proxy is the client's address
+	cfg.TrustedProxies = []string{"192.0.2.1"}
+	if r, err = middleware.NewEngine(cfg); err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+	r.POST("/nkey/apply", asUser(user), h.ApplyNKey)
+	if status := apply("198.51.100.7"); status != http.StatusOK {
+		t.Fatalf("allowed address via trusted proxy: status %d, want 200", status)
+	}
+}
+
+// A stored limit that no longer parses must deny instead of leaving the grant unrestricted
+func TestInvalidCustomLimitDenies(t *testing.T) {
+	db := newTestDB(t)
+	cfg := newTestConfig(t)
+	user := createTestUser(t, db, "alice", models.StatusUser)
+	createTestApp(t, db, "office")
+	grant := models.UserAllowedApp{UserID: user.ID, AppID: "office", Enabled: true, CustomLimit: `{"timezone":"Asia/Shanghai"}`}
+	if err := db.Create(&grant).Error; err != nil {
+		t.Fatalf("create grant: %v", err)
+	}
+
+	// Time zones come from the embedded database, whatever the host has installed
+	value, _, nkeyErr := issueNKey(db, cfg, user, []string{"office"}, "", false, false)
+	if nkeyErr != nil {
+		t.Fatalf("issue with a valid timezone: %s", nkeyErr.message)
+	}
+
+	db.Model(&grant).Update("custom_limit", `{"allowed_cidr":["10.0.0.0/8"]}`)
+	if _, nkeyErr := checkNKey(db, cfg, value, "office", "10.1.2.3"); nkeyErr == nil || nkeyErr.reason != denyInvalidLimit {
+		t.Fatalf("validation with an invalid limit: %v, want %s", nkeyErr, denyInvalidLimit)
+	}
+	if _, _, nkeyErr := issueNKey(db, cfg, user, []string{"office"}, "10.1.2.3", false, false); nkeyErr == nil || nkeyErr.status != http.StatusForbidden {
+		t.Fatalf("issuance with an invalid limit: %v, want 403", nkeyErr)
+	}
+}
@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+	"tounetcore/internal/auth"
+	"tounetcore/internal/middleware"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// recoveryCodeCount is the number of recovery codes issued on 2FA enrollment
+const recoveryCodeCount = 10
+
+// VerifyTOTPRequest represents a TOTP enrollment confirmation request
+type VerifyTOTPRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// DisableTOTPRequest represents a request to turn off 2FA
+type DisableTOTPRequest struct {
+	Password     string `json:"password" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// LoginMFARequest represents the second step of a two-step login
+type LoginMFARequest struct {
+	MFAToken     string `json:"mfa_token" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// SetupTOTP generates a new TOTP secret for the current user
+func (h *UserHandler) SetupTOTP(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var user models.User
+	if err := h.db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "user not found",
+		})
+		return
+	}
+
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{
+			"code":    409,
+			"message": "two-factor authentication already enabled",
+		})
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to generate secret",
+		})
+		return
+	}
+
+	// The secret stays pending until a code generated from it is verified
+	if err := h.db.Model(&user).Updates(map[string]interface{}{
+		"totp_secret":    secret,
+		"totp_last_step": 0,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to store secret",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"secret":      secret,
+			"otpauth_uri": auth.TOTPProvisioningURI(h.cfg.MFAIssuer, user.Username, secret),
+		},
+	})
+}
+
+// VerifyTOTP confirms TOTP enrollment and returns recovery codes
+func (h *UserHandler) VerifyTOTP(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var req VerifyTOTPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
+		})
+		return
+	}
+
+	var user models.User
+	if err := h.db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "user not found",
+		})
+		return
+	}
+
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "no pending two-factor enrollment",
+		})
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(user.TOTPSecret, req.Code, user.TOTPLastStep, time.Now())
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    401,
+			"message": "invalid code",
+		})
+		return
+	}
+
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to generate recovery codes",
+		})
+		return
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		for _, code := range codes {
+			recoveryCode := models.RecoveryCode{
+				UserID:   user.ID,
+				CodeHash: auth.HashToken(auth.NormalizeRecoveryCode(code)),
+			}
+			if err := tx.Create(&recoveryCode).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&user).Updates(map[string]interface{}{
+			"totp_enabled":   true,
+			"totp_last_step": step,
+		}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to enable two-factor authentication",
+		})
+		return
+	}
+	middleware.InvalidateUser(user.ID)
+
+	auditLog := models.AuditLog{
+		ActionType: "ENABLE_2FA",
+		TargetType: "USER",
+		TargetID:   fmt.Sprintf("%d", user.ID),
+		OperatorID: models.AuditOperator(user.ID),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("User %s enabled TOTP two-factor authentication", user.Username),
+	}
+	h.db.Create(&auditLog)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"recovery_codes": codes,
+		},
+	})
+}
+
+// DisableTOTP turns off 2FA for the current user
+func (h *UserHandler) DisableTOTP(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var req DisableTOTPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
+		})
+		return
+	}
+
+	var user models.User
+	if err := h.db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "user not found",
+		})
+		return
+	}
+
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "two-factor authentication not enabled",
+		})
+		return
+	}
+
+	// Passkeys still satisfy the policy once TOTP is removed
+	if middleware.MFARequired(h.cfg, user.Status) && !user.HasPasskeys {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code":    403,
+			"message": "two-factor authentication is required for your role",
+		})
+		return
+	}
+
+	// Password and code guesses are throttled like login
+	if wait, locked := checkLoginThrottle(h.db, h.cfg, usernameThrottleKey(user.Username), ipThrottleKey(c.ClientIP())); wait > 0 {
+		respondThrottled(c, wait, locked)
+		return
+	}
+
+	if !auth.CheckPassword(req.Password, user.PasswordHash) || !h.verifySecondFactor(&user, req.Code, req.RecoveryCode) {
+		recordFailedLogin(h.db, h.cfg, c, user.Username, user.ID)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    401,
+			"message": "invalid credentials",
+		})
+		return
+	}
+
+	if err := clearTOTP(h.db, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to disable two-factor authentication",
+		})
+		return
+	}
+	middleware.InvalidateUser(user.ID)
+	resetLoginFailures(h.db, usernameThrottleKey(user.Username))
+
+	auditLog := models.AuditLog{
+		ActionType: "DISABLE_2FA",
+		TargetType: "USER",
+		TargetID:   fmt.Sprintf("%d", user.ID),
+		OperatorID: models.AuditOperator(user.ID),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("User %s disabled TOTP two-factor authentication", user.Username),
+	}
+	h.db.Create(&auditLog)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
+
+// LoginMFA completes a two-step login with a TOTP or recovery code
+func (h *UserHandler) LoginMFA(c *gin.Context) {
+	var req LoginMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
+		})
+		return
+	}
+
+	userID, err := auth.ValidateMFAToken(req.MFAToken, h.keys)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    401,
+			"message": "invalid or expired mfa token",
+		})
+		return
+	}
+
+	var user models.User
+	if err := h.db.First(&user, userID).Error; err != nil || !user.MFAEnabled() {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    401,
+			"message": "invalid or expired mfa token",
+		})
+		return
+	}
+
+	// Second factor guesses count towards the same lockout as passwords
+	if wait, locked := checkLoginThrottle(h.db, h.cfg, usernameThrottleKey(user.Username), ipThrottleKey(c.ClientIP())); wait > 0 {
+		respondThrottled(c, wait, locked)
+		return
+	}
+
+	if !h.verifySecondFactor(&user, req.Code, req.RecoveryCode) {
+		recordFailedLogin(h.db, h.cfg, c, user.Username, user.ID)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    401,
+			"message": "invalid code",
+		})
+		return
+	}
+
+	h.completeLogin(c, &user)
+}
+
+// mfaMethods lists the second factors a user can complete a login with
+func mfaMethods(user *models.User) []string {
+	var methods []string
+	if user.TOTPEnabled {
+		methods = append(methods, "totp", "recovery_code")
+	}
+	if user.HasPasskeys {
+		methods = append(methods, "webauthn")
+	}
+	return methods
+}
+
+// verifySecondFactor consumes a TOTP code or an unused recovery code for the user
+func (h *UserHandler) verifySecondFactor(user *models.User, code, recoveryCode string) bool {
+	if !user.TOTPEnabled {
+		return false
+	}
+
+	if code != "" {
+		step, ok := auth.ValidateTOTP(user.TOTPSecret, code, user.TOTPLastStep, time.Now())
+		if !ok {
+			return false
+		}
+		// Conditional update so a code cannot be used twice by concurrent requests
+		result := h.db.Model(&models.User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			Update("totp_last_step", step)
+		return result.Error == nil && result.RowsAffected == 1
+	}
+
+	if recoveryCode != "" {
+		result := h.db.Model(&models.RecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, auth.HashToken(auth.NormalizeRecoveryCode(recoveryCode))).
+			Update("used_at", time.Now())
+		return result.Error == nil && result.RowsAffected == 1
+	}
+
+	return false
+}
+
+// clearTOTP removes a user's TOTP secret and recovery codes
+func clearTOTP(db *gorm.DB, userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"totp_secret":    "",
+			"totp_enabled":   false,
+			"totp_last_step": 0,
+		}).Error
+	})
+}
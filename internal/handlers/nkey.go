@@ -1,12 +1,17 @@
 package handlers
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 	"tounetcore/internal/auth"
 	"tounetcore/internal/config"
 	"tounetcore/internal/models"
+	"tounetcore/internal/notify"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -23,20 +28,21 @@ func NewNKeyHandler(db *gorm.DB, cfg *config.Config) *NKeyHandler {
 
 // ApplyNKeyRequest represents the request to generate an NKey
 type ApplyNKeyRequest struct {
-	Username []string `json:"username"`
-	AppIDs   []string `json:"app_ids" binding:"required"`
+	Username  []string `json:"username"`
+	AppIDs    []string `json:"app_ids" binding:"required"`
+	SingleUse bool     `json:"single_use"`
 }
 
 // ValidateNKeyRequest represents the request to validate an NKey
 type ValidateNKeyRequest struct {
-	NKey  string `json:"nkey" binding:"required"`
-	AppID string `json:"app_id" binding:"required"`
+	NKey     string `json:"nkey" binding:"required"`
+	AppID    string `json:"app_id"`    // defaults to the authenticated app
+	ClientIP string `json:"client_ip"` // end user's address, checked against the grant's allowed_cidrs
 }
 
 // ApplyNKey generates a new NKey for the user
 func (h *NKeyHandler) ApplyNKey(c *gin.Context) {
 	userID, _ := c.Get("user_id")
-	userStatus, _ := c.Get("user_status")
 
 	var req ApplyNKeyRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -57,176 +63,454 @@ func (h *NKeyHandler) ApplyNKey(c *gin.Context) {
 		return
 	}
 
+	nkey, validAppIDs, nkeyErr := issueNKey(h.db, h.cfg, &user, req.AppIDs, c.ClientIP(), req.SingleUse, true)
+	if nkeyErr != nil {
+		c.JSON(nkeyErr.status, gin.H{
+			"code":    nkeyErr.status,
+			"message": nkeyErr.message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"nkey":       nkey,
+			"expires_in": int(h.cfg.NKeyExpiration.Seconds()),
+			"apps":       validAppIDs,
+		},
+	})
+}
+
+// issueNKey checks the user's permission for every app and stores a new NKey for them.
+// With deliver set, the NKey is also sent to the user's notification channel.
+func issueNKey(db *gorm.DB, cfg *config.Config, user *models.User, appIDs []string, clientIP string, singleUse, deliver bool) (string, []string, *nkeyError) {
+	now := time.Now()
+
 	// Validate requested apps
 	var validAppIDs []string
-	for _, appID := range req.AppIDs {
+	limits := make(map[string]*CustomLimit)
+	for _, appID := range appIDs {
 		var app models.App
-		if err := h.db.Where("app_id = ? AND is_active = ?", appID, true).First(&app).Error; err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"code":    400,
-				"message": "invalid app_id: " + appID,
-			})
-			return
+		if err := db.Where("app_id = ? AND is_active = ?", appID, true).First(&app).Error; err != nil {
+			return "", nil, &nkeyError{http.StatusBadRequest, denyInvalidApp, "invalid app_id: " + appID}
 		}
 
 		// Check if user has permission for this app
-		if !h.userHasAppPermission(userID.(uint), appID, userStatus.(models.UserStatus), app.RequiredPermissionLevel) {
-			c.JSON(http.StatusForbidden, gin.H{
-				"code":    403,
-				"message": "no permission for app: " + appID,
-			})
-			return
+		if denial := appAccessDenial(db, user.ID, user.Status, &app); denial != nil {
+			return "", nil, denial
+		}
+
+		// Enforce the grant's custom limit, if any
+		limit, limitErr := grantLimit(db, user.ID, appID)
+		if limitErr != nil {
+			return "", nil, limitErr
+		}
+		if limit != nil {
+			if limitErr := limit.checkAccess(appID, clientIP, now); limitErr != nil {
+				return "", nil, limitErr
+			}
+			limits[appID] = limit
 		}
 
 		validAppIDs = append(validAppIDs, appID)
 	}
 
 	// Generate NKey
-	nkey, err := auth.GenerateNKey(userID.(uint), validAppIDs)
+	expiresAt := now.Add(cfg.NKeyExpiration)
+	claims := auth.NKeyClaims{
+		UserID:    user.ID,
+		Username:  user.Username,
+		Role:      user.Status,
+		AppIDs:    validAppIDs,
+		ExpiresAt: expiresAt.Unix(),
+		SingleUse: singleUse,
+	}
+	nkey, err := auth.GenerateNKey(cfg, &claims)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"code":    500,
-			"message": "failed to generate nkey",
-		})
-		return
+		return "", nil, &nkeyError{http.StatusInternalServerError, denyInternal, "failed to generate nkey"}
 	}
 
 	// Store NKey in database
 	appIDsJSON, _ := json.Marshal(validAppIDs)
 	nkeyRecord := models.NKey{
 		KeyValue:  nkey,
-		UserID:    userID.(uint),
+		UserID:    user.ID,
 		AppIDs:    string(appIDsJSON),
-		ExpiresAt: time.Now().Add(h.cfg.NKeyExpiration),
+		Nonce:     claims.Nonce,
+		ExpiresAt: expiresAt,
+		SingleUse: singleUse,
 	}
 
-	if err := h.db.Create(&nkeyRecord).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"code":    500,
-			"message": "failed to store nkey",
+	// The NKey is delivered to the user's notification channel through the outbox
+	msg := notify.Message{
+		Title: "TouNetCore NKey",
+		Body: fmt.Sprintf("Your NKey for %s: %s (valid for %d minutes)",
+			strings.Join(validAppIDs, ", "), nkey, int(cfg.NKeyExpiration.Minutes())),
+	}
+	// Quotas are counted in the same transaction, so a failed issuance does not use them up
+	var quotaErr *nkeyError
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for appID, limit := range limits {
+			if quotaErr = limit.consumeNKeyQuota(tx, user.ID, appID, now); quotaErr != nil {
+				return errors.New(quotaErr.message)
+			}
+		}
+		if err := tx.Create(&nkeyRecord).Error; err != nil {
+			return err
+		}
+		if !deliver {
+			return nil
+		}
+		return notify.Enqueue(tx, user.ID, "nkey_issued", "", msg)
+	})
+	if quotaErr != nil {
+		return "", nil, quotaErr
+	}
+	if err != nil {
+		return "", nil, &nkeyError{http.StatusInternalServerError, denyInternal, "failed to store nkey"}
+	}
+
+	return nkey, validAppIDs, nil
+}
+
+// ValidateNKey validates an NKey for the authenticated app
+func (h *NKeyHandler) ValidateNKey(c *gin.Context) {
+	authAppID := c.GetString("app_id")
+
+	var req ValidateNKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
 		})
 		return
 	}
 
-	// Send push notification if PushDeer token is available
-	if user.PushDeerToken != "" {
-		go h.sendPushNotification(user.PushDeerToken, nkey)
+	// An app may only validate NKeys for itself
+	if req.AppID == "" {
+		req.AppID = authAppID
+	}
+	if req.AppID != authAppID {
+		auditLog := models.AuditLog{
+			ActionType: "APP_AUTH_FAILED",
+			TargetType: "APP",
+			TargetID:   authAppID,
+			IPAddress:  c.ClientIP(),
+			UserAgent:  c.GetHeader("User-Agent"),
+			Details:    fmt.Sprintf("App %s tried to validate an NKey for app %s", authAppID, req.AppID),
+		}
+		h.db.Create(&auditLog)
+
+		c.JSON(http.StatusForbidden, gin.H{
+			"code":    403,
+			"message": "app_id does not match app credentials",
+		})
+		return
+	}
+
+	nkey, nkeyErr := checkNKey(h.db, h.cfg, req.NKey, req.AppID, req.ClientIP)
+	if nkeyErr != nil {
+		c.JSON(nkeyErr.status, gin.H{
+			"code":    nkeyErr.status,
+			"message": nkeyErr.message,
+			"reason":  nkeyErr.reason,
+		})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
 		"message": "success",
 		"data": gin.H{
-			"nkey":       nkey,
-			"expires_in": int(h.cfg.NKeyExpiration.Seconds()),
-			"apps":       validAppIDs,
+			"valid":     true,
+			"username":  nkey.User.Username,
+			"user_role": nkey.User.Status,
 		},
 	})
 }
 
-// ValidateNKey validates an NKey for a specific app
-func (h *NKeyHandler) ValidateNKey(c *gin.Context) {
-	var req ValidateNKeyRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"code":    400,
-			"message": "invalid request data",
-		})
-		return
+// Reasons an NKey is refused, reported to apps so they can tell the user why
+const (
+	denyInvalidNKey       = "invalid_nkey"
+	denyNKeyExpired       = "nkey_expired"
+	denyNKeyRevoked       = "nkey_revoked"
+	denyNKeyUsed          = "nkey_used"
+	denyAppNotInNKey      = "app_not_in_nkey"
+	denyInvalidApp        = "invalid_app"
+	denyAppInactive       = "app_inactive"
+	denyUserDeleted       = "user_deleted"
+	denyUserDisabled      = "user_disabled"
+	denyInsufficientRole  = "insufficient_role"
+	denyNotGranted        = "not_granted"
+	denyGrantDisabled     = "grant_disabled"
+	denyGrantExpired      = "grant_expired"
+	denyOutsideHours      = "outside_allowed_hours"
+	denyAddressNotAllowed = "address_not_allowed"
+	denyQuotaExceeded     = "quota_exceeded"
+	denyInvalidLimit      = "invalid_custom_limit"
+	denyInternal          = "internal_error"
+)
+
+// nkeyError is the reason an NKey was rejected and the HTTP status to report
+type nkeyError struct {
+	status  int
+	reason  string
+	message string
+}
+
+// checkNKey validates an NKey for an app and records its first use. Single-use
+// keys are only accepted for that first use.
+func checkNKey(db *gorm.DB, cfg *config.Config, value, appID, clientIP string) (*models.NKey, *nkeyError) {
+	nkey, app, limit, nkeyErr := inspectNKey(db, cfg, value, appID, clientIP)
+	if nkeyErr != nil {
+		return nil, nkeyErr
+	}
+
+	// Record the first use with a conditional update so concurrent validations
+	// cannot both claim it. Single-use keys are only valid for that first claim.
+	// The validation is counted in the same transaction, so a rejected claim is not
+	// counted and a key refused by the quota is not used up.
+	singleUse := nkey.SingleUse || app.SingleUseNKeys
+
+	var useErr *nkeyError
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if singleUse || !nkey.IsUsed {
+			result := tx.Model(&models.NKey{}).
+				Where("id = ? AND is_used = ?", nkey.ID, false).
+				Updates(map[string]interface{}{
+					"is_used":        true,
+					"first_used_at":  time.Now(),
+					"first_used_app": appID,
+				})
+			if result.Error != nil {
+				return result.Error
+			}
+			if singleUse && result.RowsAffected != 1 {
+				useErr = &nkeyError{http.StatusGone, denyNKeyUsed, "nkey already used"}
+				return errors.New(useErr.message)
+			}
+		}
+		if limit != nil {
+			if useErr = limit.consumeValidationQuota(tx, nkey.UserID, appID, time.Now()); useErr != nil {
+				return errors.New(useErr.message)
+			}
+		}
+		return nil
+	})
+	if useErr != nil {
+		return nil, useErr
+	}
+	if err != nil {
+		return nil, &nkeyError{http.StatusInternalServerError, denyInternal, "failed to record nkey use"}
+	}
+
+	return nkey, nil
+}
+
+// inspectNKey checks an NKey's state, the user's access to the app and the grant's custom
+// limit without using the key: nothing is claimed or counted. It returns the app and the
+// custom limit, if any, for callers that go on to use the key.
+func inspectNKey(db *gorm.DB, cfg *config.Config, value, appID, clientIP string) (*models.NKey, *models.App, *CustomLimit, *nkeyError) {
+	// Signed NKeys must carry a valid signature before the database is consulted
+	if auth.IsSignedNKey(value) {
+		publicKey, _, err := auth.NKeyPublicKey(cfg)
+		if err != nil {
+			return nil, nil, nil, &nkeyError{http.StatusInternalServerError, denyInternal, "nkey signing key unavailable"}
+		}
+		if _, err := auth.VerifySignedNKey(value, publicKey); errors.Is(err, auth.ErrInvalidNKey) {
+			return nil, nil, nil, &nkeyError{http.StatusUnauthorized, denyInvalidNKey, "invalid nkey"}
+		}
 	}
 
 	// Find NKey in database
 	var nkey models.NKey
-	if err := h.db.Preload("User").Where("key_value = ?", req.NKey).First(&nkey).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"code":    401,
-			"message": "invalid nkey",
-		})
-		return
+	if err := db.Preload("User").Where("key_value = ?", value).First(&nkey).Error; err != nil {
+		return nil, nil, nil, &nkeyError{http.StatusUnauthorized, denyInvalidNKey, "invalid nkey"}
 	}
 
 	// Check if NKey is expired
 	if time.Now().After(nkey.ExpiresAt) {
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"code":    401,
-			"message": "expired nkey",
-		})
-		return
+		return nil, nil, nil, &nkeyError{http.StatusUnauthorized, denyNKeyExpired, "expired nkey"}
 	}
 
-	// Check if user has permission for the requested app
+	if nkey.RevokedAt != nil {
+		return nil, nil, nil, &nkeyError{http.StatusUnauthorized, denyNKeyRevoked, "revoked nkey"}
+	}
+
+	// Check if the requested app is in the allowed apps
 	var appIDs []string
 	if err := json.Unmarshal([]byte(nkey.AppIDs), &appIDs); err != nil {
+		return nil, nil, nil, &nkeyError{http.StatusInternalServerError, denyInternal, "invalid nkey data"}
+	}
+	if !containsString(appIDs, appID) {
+		return nil, nil, nil, &nkeyError{http.StatusForbidden, denyAppNotInNKey, "no permission for app"}
+	}
+
+	var app models.App
+	if err := db.Where("app_id = ?", appID).First(&app).Error; err != nil {
+		return nil, nil, nil, &nkeyError{http.StatusForbidden, denyAppInactive, "app no longer exists"}
+	}
+	if denial := nkeyDenial(db, &nkey, &app); denial != nil {
+		return nil, nil, nil, denial
+	}
+
+	// Enforce the grant's custom limit
+	limit, limitErr := grantLimit(db, nkey.UserID, appID)
+	if limitErr != nil {
+		return nil, nil, nil, limitErr
+	}
+	if limit != nil {
+		if limitErr := limit.checkAccess(appID, clientIP, time.Now()); limitErr != nil {
+			return nil, nil, nil, limitErr
+		}
+	}
+
+	return &nkey, &app, limit, nil
+}
+
+// nkeyDenial reports why a live NKey cannot be used for one of its apps, or nil. The key's
+// single-use state, the user, the app and the user's access may all have changed since
+// issuance. Custom limits are not checked.
+func nkeyDenial(db *gorm.DB, nkey *models.NKey, app *models.App) *nkeyError {
+	if nkey.IsUsed && (nkey.SingleUse || app.SingleUseNKeys) {
+		return &nkeyError{http.StatusGone, denyNKeyUsed, "nkey already used"}
+	}
+	if nkey.User.ID == 0 {
+		return &nkeyError{http.StatusForbidden, denyUserDeleted, "user no longer exists"}
+	}
+	if !app.IsActive {
+		return &nkeyError{http.StatusForbidden, denyAppInactive, "app is inactive"}
+	}
+	return appAccessDenial(db, nkey.UserID, nkey.User.Status, app)
+}
+
+// PublicKey returns the Ed25519 public key apps use to verify signed NKeys offline
+func (h *NKeyHandler) PublicKey(c *gin.Context) {
+	if h.cfg.NKeyFormat != auth.NKeyFormatSigned {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "signed nkeys are not enabled",
+		})
+		return
+	}
+
+	publicKey, kid, err := auth.NKeyPublicKey(h.cfg)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    500,
-			"message": "invalid nkey data",
+			"message": "nkey signing key unavailable",
 		})
 		return
 	}
 
-	// Check if the requested app is in the allowed apps
-	hasPermission := false
-	for _, appID := range appIDs {
-		if appID == req.AppID {
-			hasPermission = true
-			break
-		}
-	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"format":     h.cfg.NKeyFormat,
+			"alg":        "EdDSA",
+			"kid":        kid,
+			"public_key": base64.StdEncoding.EncodeToString(publicKey),
+			"jwk": gin.H{
+				"kty": "OKP",
+				"crv": "Ed25519",
+				"use": "sig",
+				"alg": "EdDSA",
+				"kid": kid,
+				"x":   base64.RawURLEncoding.EncodeToString(publicKey),
+			},
+		},
+	})
+}
 
-	if !hasPermission {
-		c.JSON(http.StatusForbidden, gin.H{
-			"code":    403,
-			"message": "no permission for app",
+// RevocationList returns the nonces of revoked NKeys that have not yet expired,
+// so apps verifying signed NKeys offline can reject them
+func (h *NKeyHandler) RevocationList(c *gin.Context) {
+	var nkeys []models.NKey
+	if err := h.db.Where("revoked_at IS NOT NULL AND expires_at > ? AND nonce <> ''", time.Now()).
+		Order("expires_at").Find(&nkeys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to fetch revoked nkeys",
 		})
 		return
 	}
 
-	// Update first use information if not already used
-	if !nkey.IsUsed {
-		now := time.Now()
-		nkey.FirstUsedAt = &now
-		nkey.FirstUsedApp = req.AppID
-		nkey.IsUsed = true
-		h.db.Save(&nkey)
+	revoked := make([]gin.H, 0, len(nkeys))
+	for _, nkey := range nkeys {
+		revoked = append(revoked, gin.H{
+			"nonce":      nkey.Nonce,
+			"expires_at": nkey.ExpiresAt.Unix(),
+		})
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
 		"message": "success",
 		"data": gin.H{
-			"valid":     true,
-			"username":  nkey.User.Username,
-			"user_role": nkey.User.Status,
+			"revoked": revoked,
 		},
 	})
 }
 
+// revokeUserNKeys revokes every unexpired NKey of a user and returns how many were revoked
+func revokeUserNKeys(db *gorm.DB, userID uint) (int64, error) {
+	result := db.Model(&models.NKey{}).
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Update("revoked_at", time.Now())
+	return result.RowsAffected, result.Error
+}
+
 // userHasAppPermission checks if a user has permission for a specific app
-func (h *NKeyHandler) userHasAppPermission(userID uint, appID string, userStatus models.UserStatus, requiredLevel models.UserStatus) bool {
-	// Check basic permission level using the new hierarchy
-	if !userStatus.HasPermission(requiredLevel) {
-		return false
-	}
+func userHasAppPermission(db *gorm.DB, userID uint, userStatus models.UserStatus, app *models.App) bool {
+	return appAccessDenial(db, userID, userStatus, app) == nil
+}
 
+// appAccessDenial evaluates the user's role and grant against the app's access mode,
+// and returns why access is refused, or nil when it is allowed
+func appAccessDenial(db *gorm.DB, userID uint, userStatus models.UserStatus, app *models.App) *nkeyError {
 	// Check user-specific app permissions
 	var userApp models.UserAllowedApp
-	if err := h.db.Where("user_id = ? AND app_id = ?", userID, appID).First(&userApp).Error; err == nil {
-		// User has specific permission settings
+	hasGrant := db.Where("user_id = ? AND app_id = ?", userID, app.AppID).First(&userApp).Error == nil
+	if hasGrant {
 		if !userApp.Enabled {
-			return false
+			return &nkeyError{http.StatusForbidden, denyGrantDisabled, "access disabled for app: " + app.AppID}
 		}
-		if userApp.ValidUntil != nil && time.Now().After(*userApp.ValidUntil) {
-			return false
+		if userApp.ValidUntil != nil && !time.Now().Before(*userApp.ValidUntil) {
+			return &nkeyError{http.StatusForbidden, denyGrantExpired, "access expired for app: " + app.AppID}
 		}
 	}
 
-	return true
+	if appOpenTo(app, userStatus, hasGrant) {
+		return nil
+	}
+	switch {
+	case userStatus == models.StatusDisabledUser:
+		return &nkeyError{http.StatusForbidden, denyUserDisabled, "user is disabled"}
+	case app.AccessMode == models.AccessAllowList && !hasGrant:
+		return &nkeyError{http.StatusForbidden, denyNotGranted, "no permission for app: " + app.AppID}
+	default:
+		return &nkeyError{http.StatusForbidden, denyInsufficientRole, "insufficient role for app: " + app.AppID}
+	}
+}
+
+// appOpenTo reports whether the app's access mode admits a user with the given role,
+// with or without a grant. The grant's own enabled and valid_until state is not checked.
+func appOpenTo(app *models.App, userStatus models.UserStatus, hasGrant bool) bool {
+	switch app.AccessMode {
+	case models.AccessAllowList:
+		return hasGrant && userStatus.HasPermission(app.RequiredPermissionLevel)
+	case models.AccessDenyList:
+		// The required level is not enforced, but disabled users stay out
+		return userStatus != models.StatusDisabledUser
+	default:
+		return userStatus.HasPermission(app.RequiredPermissionLevel)
+	}
 }
 
-// sendPushNotification sends a push notification via PushDeer
-func (h *NKeyHandler) sendPushNotification(token, nkey string) {
-	// Implementation for PushDeer notification
-	// This is a placeholder - implement actual HTTP request to PushDeer API
-	// Example: POST to https://api2.pushdeer.com/message/push
-	// with pushkey=token and text=nkey
+// grantActive reports whether a grant is enabled and not expired
+func grantActive(grant *models.UserAllowedApp) bool {
+	return grant.Enabled && (grant.ValidUntil == nil || time.Now().Before(*grant.ValidUntil))
 }
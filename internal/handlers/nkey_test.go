@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"tounetcore/internal/middleware"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func TestSingleUseNKeyConcurrentValidation(t *testing.T) {
+	testSingleUseNKeyConcurrentValidation(t, newTestDB(t))
+}
+
+func TestSingleUseNKeyConcurrentValidationPostgres(t *testing.T) {
+	testSingleUseNKeyConcurrentValidation(t, newPostgresTestDB(t))
+}
+
+// testSingleUseNKeyConcurrentValidation validates one single-use NKey from many requests
+// at once and expects exactly one of them to claim it
+func testSingleUseNKeyConcurrentValidation(t *testing.T, db *gorm.DB) {
+	const validations = 16
+
+	cfg := newTestConfig(t)
+	user := createTestUser(t, db, "alice", models.StatusUser)
+	app := createTestApp(t, db, "racer")
+
+	value, _, nkeyErr := issueNKey(db, cfg, user, []string{app.AppID}, "", true, false)
+	if nkeyErr != nil {
+		t.Fatalf("issue nkey: %s", nkeyErr.message)
+	}
+
+	h := NewNKeyHandler(db, cfg)
+	r := gin.New()
+	r.POST("/validate", func(c *gin.Context) {
+		// Stands in for AppAuthMiddleware
+		c.Set("app_id", app.AppID)
+		c.Next()
+	}, h.ValidateNKey)
+
+	body, _ := json.Marshal(ValidateNKeyRequest{NKey: value, AppID: app.AppID})
+
+	type outcome struct {
+		status int
+		reason string
+	}
+	outcomes := make([]outcome, validations)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < validations; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body)))
+			var out struct {
+				Reason string `json:"reason"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &out)
+			outcomes[i] = outcome{w.Code, out.Reason}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	accepted := 0
+	for i, o := range outcomes {
+		switch {
+		case o.status == http.StatusOK:
+			accepted++
+		case o.status == http.StatusGone && o.reason == denyNKeyUsed:
+		default:
+			t.Errorf("validation %d: status %d reason %q, want 200 or 410 %s", i, o.status, o.reason, denyNKeyUsed)
+		}
+	}
+	if accepted != 1 {
+		t.Fatalf("%d validations accepted, want exactly 1", accepted)
+	}
+}
+
+// A request signature covers the method and URI, so it cannot be replayed against
+// another app endpoint
+func TestAppSignatureIsBoundToRequest(t *testing.T) {
+	db := newTestDB(t)
+	cfg := newTestConfig(t)
+	app := createTestApp(t, db, "signer")
+
+	h := NewNKeyHandler(db, cfg)
+	r := gin.New()
+	r.POST("/nkey/validate", middleware.AppAuthMiddleware(db), h.ValidateNKey)
+	r.GET("/nkey/revoked", middleware.AppAuthMiddleware(db), h.RevocationList)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := middleware.AppSignature(app.SecretKey, timestamp, http.MethodGet, "/nkey/revoked", nil)
+	send := func(method, target string) int {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("X-App-ID", app.AppID)
+		req.Header.Set("X-App-Timestamp", timestamp)
+		req.Header.Set("X-App-Signature", signature)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if status := send(http.MethodGet, "/nkey/revoked"); status != http.StatusOK {
+		t.Fatalf("signed request: status %d, want 200", status)
+	}
+	if status := send(http.MethodPost, "/nkey/validate"); status != http.StatusUnauthorized {
+		t.Fatalf("replayed on another endpoint: status %d, want 401", status)
+	}
+	if status := send(http.MethodGet, "/nkey/revoked?page=2"); status != http.StatusUnauthorized {
+		t.Fatalf("replayed with another query: status %d, want 401", status)
+	}
+}
@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// NKey states reported in key listings
+const (
+	nkeyStateActive  = "active"
+	nkeyStateUsed    = "used"
+	nkeyStateExpired = "expired"
+	nkeyStateRevoked = "revoked"
+)
+
+// ListNKeys returns the NKeys the user has generated, newest first, with pagination
+func (h *NKeyHandler) ListNKeys(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	list, total, err := pageNKeys(h.db, c, userID.(uint))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to fetch nkeys",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"total": total,
+			"nkeys": list,
+		},
+	})
+}
+
+// RevokeNKey revokes one of the user's own NKeys
+func (h *NKeyHandler) RevokeNKey(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var nkey models.NKey
+	if err := h.db.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&nkey).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "nkey not found",
+		})
+		return
+	}
+
+	if err := revokeNKey(h.db, &nkey); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to revoke nkey",
+		})
+		return
+	}
+
+	auditLog := models.AuditLog{
+		ActionType: "REVOKE_NKEY",
+		TargetType: "NKEY",
+		TargetID:   fmt.Sprintf("%d", nkey.ID),
+		OperatorID: models.AuditOperator(userID.(uint)),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("User revoked their NKey %d", nkey.ID),
+	}
+	h.db.Create(&auditLog)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    describeNKey(&nkey, singleUseApps(h.db)),
+	})
+}
+
+// ListUserNKeys returns a user's NKeys with pagination (admin only)
+func (h *AdminHandler) ListUserNKeys(c *gin.Context) {
+	var user models.User
+	if err := h.db.First(&user, c.Param("user_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "user not found",
+		})
+		return
+	}
+
+	list, total, err := pageNKeys(h.db, c, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to fetch nkeys",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"total": total,
+			"nkeys": list,
+		},
+	})
+}
+
+// RevokeNKey revokes any single NKey (admin only)
+func (h *AdminHandler) RevokeNKey(c *gin.Context) {
+	operatorID, _ := c.Get("user_id")
+
+	var nkey models.NKey
+	if err := h.db.First(&nkey, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "nkey not found",
+		})
+		return
+	}
+
+	if err := revokeNKey(h.db, &nkey); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to revoke nkey",
+		})
+		return
+	}
+
+	auditLog := models.AuditLog{
+		ActionType: "REVOKE_NKEY",
+		TargetType: "NKEY",
+		TargetID:   fmt.Sprintf("%d", nkey.ID),
+		OperatorID: models.AuditOperator(operatorID.(uint)),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("Revoked NKey %d of user %d", nkey.ID, nkey.UserID),
+	}
+	h.db.Create(&auditLog)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    describeNKey(&nkey, singleUseApps(h.db)),
+	})
+}
+
+// RevokeUserNKeys revokes every unexpired NKey of a user, leaving their sessions alone (admin only)
+func (h *AdminHandler) RevokeUserNKeys(c *gin.Context) {
+	operatorID, _ := c.Get("user_id")
+
+	var user models.User
+	if err := h.db.First(&user, c.Param("user_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "user not found",
+		})
+		return
+	}
+
+	revoked, err := revokeUserNKeys(h.db, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to revoke nkeys",
+		})
+		return
+	}
+
+	auditLog := models.AuditLog{
+		ActionType: "REVOKE_USER_NKEYS",
+		TargetType: "USER",
+		TargetID:   fmt.Sprintf("%d", user.ID),
+		OperatorID: models.AuditOperator(operatorID.(uint)),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("Revoked %d NKeys of user %s", revoked, user.Username),
+	}
+	h.db.Create(&auditLog)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"revoked": revoked,
+		},
+	})
+}
+
+// RevokeAppNKeys revokes every unexpired NKey issued for an app (admin only)
+func (h *AdminHandler) RevokeAppNKeys(c *gin.Context) {
+	operatorID, _ := c.Get("user_id")
+	appID := c.Param("app_id")
+
+	var app models.App
+	if err := h.db.Where("app_id = ?", appID).First(&app).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "app not found",
+		})
+		return
+	}
+
+	// app_ids is a JSON array, so the keys are matched after decoding it
+	var nkeys []models.NKey
+	if err := h.db.Where("revoked_at IS NULL AND expires_at > ?", time.Now()).Find(&nkeys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to fetch nkeys",
+		})
+		return
+	}
+	var ids []uint
+	for _, nkey := range nkeys {
+		if containsString(nkeyAppIDs(&nkey), app.AppID) {
+			ids = append(ids, nkey.ID)
+		}
+	}
+
+	var revoked int64
+	if len(ids) > 0 {
+		result := h.db.Model(&models.NKey{}).Where("id IN ? AND revoked_at IS NULL", ids).Update("revoked_at", time.Now())
+		if result.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"code":    500,
+				"message": "failed to revoke nkeys",
+			})
+			return
+		}
+		revoked = result.RowsAffected
+	}
+
+	auditLog := models.AuditLog{
+		ActionType: "REVOKE_APP_NKEYS",
+		TargetType: "APP",
+		TargetID:   app.AppID,
+		OperatorID: models.AuditOperator(operatorID.(uint)),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("Revoked %d NKeys for app %s", revoked, app.AppID),
+	}
+	h.db.Create(&auditLog)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"revoked": revoked,
+		},
+	})
+}
+
+// pageNKeys returns one page of a user's NKeys, newest first, and their total count
+func pageNKeys(db *gorm.DB, c *gin.Context, userID uint) ([]gin.H, int64, error) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	size, _ := strconv.Atoi(c.DefaultQuery("size", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if size < 1 || size > 100 {
+		size = 20
+	}
+
+	offset := (page - 1) * size
+
+	var nkeys []models.NKey
+	var total int64
+
+	db.Model(&models.NKey{}).Where("user_id = ?", userID).Count(&total)
+	if err := db.Where("user_id = ?", userID).Offset(offset).Limit(size).Order("created_at DESC, id DESC").Find(&nkeys).Error; err != nil {
+		return nil, 0, err
+	}
+
+	singleUse := singleUseApps(db)
+	list := make([]gin.H, 0, len(nkeys))
+	for i := range nkeys {
+		list = append(list, describeNKey(&nkeys[i], singleUse))
+	}
+	return list, total, nil
+}
+
+// describeNKey builds the listing entry of an NKey. The key itself is never shown again,
+// only its last characters so the user can tell keys apart.
+func describeNKey(nkey *models.NKey, singleUseApps map[string]bool) gin.H {
+	hint := nkey.KeyValue
+	if len(hint) > 6 {
+		hint = "..." + hint[len(hint)-6:]
+	}
+
+	return gin.H{
+		"id":             nkey.ID,
+		"key_hint":       hint,
+		"apps":           nkeyAppIDs(nkey),
+		"state":          nkeyState(nkey, singleUseApps),
+		"single_use":     nkey.SingleUse,
+		"created_at":     nkey.CreatedAt,
+		"expires_at":     nkey.ExpiresAt,
+		"first_used_at":  nkey.FirstUsedAt,
+		"first_used_app": nkey.FirstUsedApp,
+		"revoked_at":     nkey.RevokedAt,
+	}
+}
+
+// nkeyState reports whether an NKey is revoked, expired, used up or still active.
+// As in checkNKey, a used key is used up for single-use keys and for apps with
+// single_use_nkeys; it stays active while one of its apps would still accept it.
+func nkeyState(nkey *models.NKey, singleUseApps map[string]bool) string {
+	switch {
+	case nkey.RevokedAt != nil:
+		return nkeyStateRevoked
+	case time.Now().After(nkey.ExpiresAt):
+		return nkeyStateExpired
+	case nkey.IsUsed && nkey.SingleUse:
+		return nkeyStateUsed
+	case nkey.IsUsed:
+		for _, appID := range nkeyAppIDs(nkey) {
+			if !singleUseApps[appID] {
+				return nkeyStateActive
+			}
+		}
+		return nkeyStateUsed
+	default:
+		return nkeyStateActive
+	}
+}
+
+// singleUseApps returns the IDs of apps whose NKeys are consumed by their first validation
+func singleUseApps(db *gorm.DB) map[string]bool {
+	var appIDs []string
+	db.Model(&models.App{}).Where("single_use_nkeys = ?", true).Pluck("app_id", &appIDs)
+
+	apps := make(map[string]bool, len(appIDs))
+	for _, appID := range appIDs {
+		apps[appID] = true
+	}
+	return apps
+}
+
+// nkeyAppIDs decodes the apps an NKey was issued for
+func nkeyAppIDs(nkey *models.NKey) []string {
+	appIDs := []string{}
+	json.Unmarshal([]byte(nkey.AppIDs), &appIDs)
+	return appIDs
+}
+
+// revokeNKey marks an NKey revoked; revoking it again keeps the original time
+func revokeNKey(db *gorm.DB, nkey *models.NKey) error {
+	if nkey.RevokedAt != nil {
+		return nil
+	}
+	now := time.Now()
+	if err := db.Model(nkey).Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	nkey.RevokedAt = &now
+	return nil
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"tounetcore/internal/models"
+	"tounetcore/internal/notify"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListNotifications returns outbox notifications with pagination (admin only).
+// Filter with ?status=pending|sent|dead|skipped and ?user_id=.
+func (h *AdminHandler) ListNotifications(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	size, _ := strconv.Atoi(c.DefaultQuery("size", "10"))
+
+	if page < 1 {
+		page = 1
+	}
+	if size < 1 || size > 100 {
+		size = 10
+	}
+
+	offset := (page - 1) * size
+
+	query := h.db.Model(&models.Notification{})
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var total int64
+	query.Count(&total)
+
+	var notifications []models.Notification
+	if err := query.Preload("User").Offset(offset).Limit(size).Order("created_at DESC").Find(&notifications).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to fetch notifications",
+		})
+		return
+	}
+
+	var notificationList []gin.H
+	for _, notification := range notifications {
+		notificationList = append(notificationList, gin.H{
+			"id":              notification.ID,
+			"user_id":         notification.UserID,
+			"username":        notification.User.Username,
+			"event":           notification.Event,
+			"channel":         notification.Channel,
+			"title":           notification.Title,
+			"status":          notification.Status,
+			"attempts":        notification.Attempts,
+			"next_attempt_at": notification.NextAttemptAt,
+			"last_error":      notification.LastError,
+			"delivered_via":   notification.DeliveredVia,
+			"sent_at":         notification.SentAt,
+			"created_at":      notification.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"total":         total,
+			"notifications": notificationList,
+		},
+	})
+}
+
+// RetryNotification requeues a dead notification for delivery (admin only)
+func (h *AdminHandler) RetryNotification(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid notification id",
+		})
+		return
+	}
+
+	if err := notify.Retry(h.db, uint(id)); err != nil {
+		if errors.Is(err, notify.ErrNotRetryable) || errors.Is(err, notify.ErrSecretNotification) {
+			c.JSON(http.StatusConflict, gin.H{
+				"code":    409,
+				"message": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to retry notification",
+		})
+		return
+	}
+
+	operatorID, _ := c.Get("user_id")
+	auditLog := models.AuditLog{
+		ActionType: "RETRY_NOTIFICATION",
+		TargetType: "NOTIFICATION",
+		TargetID:   c.Param("id"),
+		OperatorID: models.AuditOperator(operatorID.(uint)),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("Requeued notification %d", id),
+	}
+	h.db.Create(&auditLog)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
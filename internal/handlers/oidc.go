@@ -0,0 +1,683 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"tounetcore/internal/auth"
+	"tounetcore/internal/config"
+	"tounetcore/internal/middleware"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// oidcScopes are the scopes TouNetCore grants to OIDC clients
+var oidcScopes = []string{"openid", "profile", "email", "phone", "offline_access"}
+
+// OIDCHandler implements the OpenID Connect provider endpoints. Apps are the clients:
+// the app ID is the client ID and the app secret key is the client secret.
+type OIDCHandler struct {
+	db   *gorm.DB
+	cfg  *config.Config
+	keys *auth.KeySet
+}
+
+func NewOIDCHandler(db *gorm.DB, cfg *config.Config, keys *auth.KeySet) *OIDCHandler {
+	return &OIDCHandler{db: db, cfg: cfg, keys: keys}
+}
+
+// AuthorizeRequest represents an OIDC authorization request
+type AuthorizeRequest struct {
+	ResponseType        string `form:"response_type" json:"response_type"`
+	ClientID            string `form:"client_id" json:"client_id"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	Nonce               string `form:"nonce" json:"nonce"`
+	Prompt              string `form:"prompt" json:"prompt"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+	Approve             bool   `form:"-" json:"approve"` // set by the login page once the user consents
+}
+
+// Discovery returns the OpenID Provider configuration document
+func (h *OIDCHandler) Discovery(c *gin.Context) {
+	issuer := h.cfg.OIDCIssuer
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                        issuer,
+		"authorization_endpoint":                        issuer + "/oauth/authorize",
+		"token_endpoint":                                issuer + "/oauth/token",
+		"userinfo_endpoint":                             issuer + "/oauth/userinfo",
+		"end_session_endpoint":                          issuer + "/oauth/logout",
+		"jwks_uri":                                      issuer + "/.well-known/jwks.json",
+		"introspection_endpoint":                        issuer + "/oauth/introspect",
+		"revocation_endpoint":                           issuer + "/oauth/revoke",
+		"scopes_supported":                              oidcScopes,
+		"response_types_supported":                      []string{"code"},
+		"response_modes_supported":                      []string{"query"},
+		"grant_types_supported":                         []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":                       []string{"public"},
+		"id_token_signing_alg_values_supported":         []string{h.keys.Algorithm()},
+		"token_endpoint_auth_methods_supported":         []string{"client_secret_basic", "client_secret_post"},
+		"introspection_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"revocation_endpoint_auth_methods_supported":    []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":              []string{auth.PKCEMethodS256},
+		"claims_supported": []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "sid",
+			"preferred_username", "name", "role", "email", "email_verified", "phone_number", "phone_number_verified",
+		},
+	})
+}
+
+// Authorize validates an authorization request and sends the browser to the login page,
+// which completes the request through Consent once the user has signed in
+func (h *OIDCHandler) Authorize(c *gin.Context) {
+	var req AuthorizeRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
+		})
+		return
+	}
+
+	app, errCode, description := h.checkAuthorizeRequest(&req)
+	if app == nil {
+		// Never redirect to an unverified redirect URI
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": description,
+		})
+		return
+	}
+	if errCode == "" && req.Prompt == "none" {
+		errCode, description = "login_required", "the user must sign in"
+	}
+	if errCode != "" {
+		c.Redirect(http.StatusFound, authorizeErrorRedirect(&req, errCode, description))
+		return
+	}
+
+	c.Redirect(http.StatusFound, withQuery(h.cfg.OIDCLoginURL, c.Request.URL.Query()))
+}
+
+// Consent completes an authorization request for the signed-in user. The response
+// carries the client redirect with either an authorization code or an error.
+func (h *OIDCHandler) Consent(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	userStatus, _ := c.Get("user_status")
+
+	var req AuthorizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
+		})
+		return
+	}
+
+	app, errCode, description := h.checkAuthorizeRequest(&req)
+	if app == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": description,
+		})
+		return
+	}
+
+	var user models.User
+	if err := h.db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "user not found",
+		})
+		return
+	}
+
+	if errCode == "" && !req.Approve {
+		errCode, description = "access_denied", "the user denied the request"
+	} else if errCode == "" && !userHasAppPermission(h.db, user.ID, userStatus.(models.UserStatus), app) {
+		errCode, description = "access_denied", "the user is not allowed to use this app"
+		h.audit(c, "OIDC_ACCESS_DENIED", &user, app.AppID, fmt.Sprintf("User %s denied OIDC access to app %s", user.Username, app.AppID))
+	}
+	if errCode != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    200,
+			"message": "success",
+			"data":    gin.H{"redirect_to": authorizeErrorRedirect(&req, errCode, description)},
+		})
+		return
+	}
+
+	code, err := auth.GenerateRefreshToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to generate authorization code",
+		})
+		return
+	}
+
+	authTime := time.Now()
+	if user.LastLogin != nil {
+		authTime = *user.LastLogin
+	}
+
+	// Expired codes can no longer be exchanged
+	h.db.Where("expires_at < ?", time.Now()).Delete(&models.OAuthAuthorizationCode{})
+
+	authCode := models.OAuthAuthorizationCode{
+		CodeHash:            auth.HashToken(code),
+		AppID:               app.AppID,
+		UserID:              user.ID,
+		RedirectURI:         req.RedirectURI,
+		Scope:               strings.Join(parseScope(req.Scope), " "),
+		Nonce:               req.Nonce,
+		CodeChallenge:       req.CodeChallenge,
+		CodeChallengeMethod: req.CodeChallengeMethod,
+		AuthTime:            authTime,
+		ExpiresAt:           time.Now().Add(h.cfg.OIDCCodeExpiration),
+	}
+	if err := h.db.Create(&authCode).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to create authorization code",
+		})
+		return
+	}
+
+	h.audit(c, "OIDC_AUTHORIZE", &user, app.AppID, fmt.Sprintf("User %s authorized app %s for scope %q", user.Username, app.AppID, authCode.Scope))
+
+	params := url.Values{"code": {code}}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    gin.H{"redirect_to": withQuery(req.RedirectURI, params)},
+	})
+}
+
+// Token exchanges an authorization code or a refresh token for tokens
+func (h *OIDCHandler) Token(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	app, ok := h.authenticateClient(c)
+	if !ok {
+		return
+	}
+
+	switch c.PostForm("grant_type") {
+	case "authorization_code":
+		h.exchangeCode(c, app)
+	case "refresh_token":
+		h.refreshClientToken(c, app)
+	default:
+		oauthError(c, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code or refresh_token")
+	}
+}
+
+// exchangeCode redeems a one-time authorization code
+func (h *OIDCHandler) exchangeCode(c *gin.Context, app *models.App) {
+	var authCode models.OAuthAuthorizationCode
+	if err := h.db.Where("code_hash = ?", auth.HashToken(c.PostForm("code"))).First(&authCode).Error; err != nil || authCode.AppID != app.AppID {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "invalid authorization code")
+		return
+	}
+
+	if authCode.UsedAt != nil {
+		h.codeReplayed(c, &authCode)
+		return
+	}
+	if time.Now().After(authCode.ExpiresAt) {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "authorization code expired")
+		return
+	}
+	if c.PostForm("redirect_uri") != authCode.RedirectURI {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the authorization request")
+		return
+	}
+	if authCode.CodeChallenge != "" && !auth.VerifyPKCE(c.PostForm("code_verifier"), authCode.CodeChallenge) {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "invalid code_verifier")
+		return
+	}
+
+	// The user may have been disabled or lost access since consenting
+	var user models.User
+	if err := h.db.First(&user, authCode.UserID).Error; err != nil ||
+		!userHasAppPermission(h.db, user.ID, user.Status, app) {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "the user is not allowed to use this app")
+		return
+	}
+
+	familyID, err := auth.GenerateSessionID()
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	// Consume the code atomically so it cannot be exchanged twice
+	var refreshToken string
+	errCodeUsed := errors.New("authorization code already used")
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.OAuthAuthorizationCode{}).
+			Where("id = ? AND used_at IS NULL", authCode.ID).
+			Updates(map[string]interface{}{"used_at": time.Now(), "family_id": familyID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return errCodeUsed
+		}
+
+		var err error
+		refreshToken, err = createSession(tx, h.cfg, c, user.ID, familyID, app.AppID, authCode.Scope)
+		return err
+	})
+	if errors.Is(err, errCodeUsed) {
+		h.db.First(&authCode, authCode.ID)
+		h.codeReplayed(c, &authCode)
+		return
+	}
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	data, err := h.clientTokenResponse(&user, app, familyID, refreshToken, authCode.Scope, authCode.Nonce, authCode.AuthTime)
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	h.audit(c, "OIDC_TOKEN_ISSUED", &user, app.AppID, fmt.Sprintf("Issued OIDC tokens to app %s for user %s", app.AppID, user.Username))
+
+	c.JSON(http.StatusOK, data)
+}
+
+// codeReplayed rejects a reused authorization code and revokes the tokens issued for it
+func (h *OIDCHandler) codeReplayed(c *gin.Context, authCode *models.OAuthAuthorizationCode) {
+	if authCode.FamilyID != "" {
+		revokeSessionFamily(h.db, authCode.FamilyID)
+	}
+
+	auditLog := models.AuditLog{
+		ActionType: "OIDC_CODE_REUSE",
+		TargetType: "APP",
+		TargetID:   authCode.AppID,
+		OperatorID: models.AuditOperator(authCode.UserID),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("Authorization code reused by app %s, session family %s revoked", authCode.AppID, authCode.FamilyID),
+	}
+	h.db.Create(&auditLog)
+
+	oauthError(c, http.StatusBadRequest, "invalid_grant", "authorization code already used")
+}
+
+// refreshClientToken rotates a refresh token issued to the client
+func (h *OIDCHandler) refreshClientToken(c *gin.Context, app *models.App) {
+	var session models.Session
+	if err := h.db.Where("refresh_token_hash = ?", auth.HashToken(c.PostForm("refresh_token"))).First(&session).Error; err != nil ||
+		session.ClientID != app.AppID {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "invalid refresh token")
+		return
+	}
+	if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "invalid or expired refresh token")
+		return
+	}
+
+	var user models.User
+	if err := h.db.First(&user, session.UserID).Error; err != nil ||
+		!userHasAppPermission(h.db, user.ID, user.Status, app) {
+		revokeSessionFamily(h.db, session.FamilyID)
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "the user is not allowed to use this app")
+		return
+	}
+
+	refreshToken, reused, err := rotateSession(h.db, h.cfg, c, &session)
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if reused {
+		revokeSessionFamily(h.db, session.FamilyID)
+		h.audit(c, "REFRESH_TOKEN_REUSE", &user, app.AppID, fmt.Sprintf("Refresh token reused by app %s for user %s, session family revoked", app.AppID, user.Username))
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "refresh token reuse detected, session revoked")
+		return
+	}
+
+	data, err := h.clientTokenResponse(&user, app, session.FamilyID, refreshToken, session.Scope, "", time.Time{})
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	c.JSON(http.StatusOK, data)
+}
+
+// clientTokenResponse signs the access and ID tokens for a client session family
+func (h *OIDCHandler) clientTokenResponse(user *models.User, app *models.App, familyID, refreshToken, scope, nonce string, authTime time.Time) (gin.H, error) {
+	accessToken, err := auth.GenerateClientAccessToken(user, familyID, app.AppID, scope, h.cfg.OIDCIssuer, h.keys, h.cfg.JWTExpiration)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &auth.IDTokenClaims{
+		Nonce:     nonce,
+		SessionID: familyID,
+	}
+	claims.Issuer = h.cfg.OIDCIssuer
+	claims.Subject = fmt.Sprintf("%d", user.ID)
+	claims.Audience = []string{app.AppID}
+	if !authTime.IsZero() {
+		claims.AuthTime = authTime.Unix()
+	}
+	if hasScope(scope, "profile") {
+		claims.PreferredUsername = user.Username
+		claims.Role = user.Status
+	}
+	idToken, err := auth.GenerateIDToken(claims, h.keys, app.SecretKey, h.cfg.JWTExpiration)
+	if err != nil {
+		return nil, err
+	}
+
+	data := gin.H{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(h.cfg.JWTExpiration.Seconds()),
+		"scope":        scope,
+		"id_token":     idToken,
+	}
+	if hasScope(scope, "offline_access") {
+		data["refresh_token"] = refreshToken
+	}
+	return data, nil
+}
+
+// UserInfo returns the claims of the access token's user allowed by its scope
+func (h *OIDCHandler) UserInfo(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	scope, _ := c.Get("scope")
+
+	var user models.User
+	if err := h.db.First(&user, userID).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error":             "invalid_token",
+			"error_description": "user not found",
+		})
+		return
+	}
+
+	info := gin.H{"sub": fmt.Sprintf("%d", user.ID)}
+	if hasScope(scope.(string), "profile") {
+		info["preferred_username"] = user.Username
+		info["name"] = user.Username
+		info["role"] = user.Status
+		info["updated_at"] = user.UpdatedAt.Unix()
+	}
+	if hasScope(scope.(string), "email") && user.Email != "" {
+		info["email"] = user.Email
+		info["email_verified"] = false
+	}
+	if hasScope(scope.(string), "phone") && user.Phone != "" {
+		info["phone_number"] = user.Phone
+		info["phone_number_verified"] = false
+	}
+
+	c.JSON(http.StatusOK, info)
+}
+
+// EndSession revokes the client session named by the ID token hint and returns
+// the browser to a registered post-logout redirect URI
+func (h *OIDCHandler) EndSession(c *gin.Context) {
+	clientID := c.Query("client_id")
+
+	if hint := c.Query("id_token_hint"); hint != "" {
+		claims, err := auth.ParseIDTokenHint(hint, h.keys, h.cfg.OIDCIssuer, h.clientSecret)
+		if err != nil || (clientID != "" && claims.Audience[0] != clientID) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "invalid id_token_hint",
+			})
+			return
+		}
+		clientID = claims.Audience[0]
+
+		var session models.Session
+		if claims.SessionID != "" && h.db.Where("family_id = ? AND client_id = ?", claims.SessionID, clientID).First(&session).Error == nil {
+			revokeSessionFamily(h.db, session.FamilyID)
+
+			auditLog := models.AuditLog{
+				ActionType: "OIDC_LOGOUT",
+				TargetType: "SESSION",
+				TargetID:   session.FamilyID,
+				OperatorID: models.AuditOperator(session.UserID),
+				IPAddress:  c.ClientIP(),
+				UserAgent:  c.GetHeader("User-Agent"),
+				Details:    fmt.Sprintf("OIDC logout from app %s", clientID),
+			}
+			h.db.Create(&auditLog)
+		}
+	}
+
+	redirectURI := c.Query("post_logout_redirect_uri")
+	if redirectURI == "" {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    200,
+			"message": "success",
+		})
+		return
+	}
+
+	var app models.App
+	if clientID == "" || h.db.Where("app_id = ?", clientID).First(&app).Error != nil ||
+		!containsString(decodeStringList(app.PostLogoutRedirectURIs), redirectURI) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "post_logout_redirect_uri is not registered for the client",
+		})
+		return
+	}
+
+	params := url.Values{}
+	if state := c.Query("state"); state != "" {
+		params.Set("state", state)
+	}
+	c.Redirect(http.StatusFound, withQuery(redirectURI, params))
+}
+
+// checkAuthorizeRequest validates an authorization request. It returns a nil app when the
+// client or redirect URI is invalid, and otherwise an OAuth error code for any other problem.
+func (h *OIDCHandler) checkAuthorizeRequest(req *AuthorizeRequest) (*models.App, string, string) {
+	var app models.App
+	if req.ClientID == "" || h.db.Where("app_id = ?", req.ClientID).First(&app).Error != nil {
+		return nil, "", "unknown client_id"
+	}
+	if req.RedirectURI == "" || !containsString(decodeStringList(app.RedirectURIs), req.RedirectURI) {
+		return nil, "", "redirect_uri is not registered for the client"
+	}
+
+	switch {
+	case !app.IsActive:
+		return &app, "unauthorized_client", "the app is inactive"
+	case req.ResponseType != "code":
+		return &app, "unsupported_response_type", "only the code response type is supported"
+	case !hasScope(req.Scope, "openid"):
+		return &app, "invalid_scope", "the openid scope is required"
+	case req.CodeChallenge == "" && h.cfg.OIDCRequirePKCE:
+		return &app, "invalid_request", "code_challenge is required"
+	case req.CodeChallenge != "" && req.CodeChallengeMethod != auth.PKCEMethodS256:
+		return &app, "invalid_request", "code_challenge_method must be S256"
+	}
+	return &app, "", ""
+}
+
+// authenticateClient checks client_secret_basic or client_secret_post credentials
+func (h *OIDCHandler) authenticateClient(c *gin.Context) (*models.App, bool) {
+	clientID, secret, basic := c.Request.BasicAuth()
+	if basic {
+		// RFC 6749 form-encodes credentials inside the Basic header
+		if id, err := url.QueryUnescape(clientID); err == nil {
+			clientID = id
+		}
+		if formID := c.PostForm("client_id"); formID != "" && formID != clientID {
+			oauthError(c, http.StatusBadRequest, "invalid_request", "client_id does not match the credentials")
+			return nil, false
+		}
+	} else {
+		clientID, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+
+	fail := func(reason string) (*models.App, bool) {
+		middleware.LogAppAuthFailure(h.db, c, clientID, reason)
+		if basic {
+			c.Header("WWW-Authenticate", `Basic realm="tounetcore"`)
+		}
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "invalid client credentials")
+		return nil, false
+	}
+
+	if clientID == "" {
+		return fail("missing client credentials")
+	}
+	var app models.App
+	if err := h.db.Where("app_id = ?", clientID).First(&app).Error; err != nil {
+		return fail("unknown app")
+	}
+	if !clientSecretMatches(app.SecretKey, secret) {
+		return fail("wrong secret key")
+	}
+	if !app.IsActive {
+		return fail("app is inactive")
+	}
+	return &app, true
+}
+
+// clientSecretMatches compares a client secret, accepting it with or without form encoding
+func clientSecretMatches(expected, secret string) bool {
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) == 1 {
+		return true
+	}
+	decoded, err := url.QueryUnescape(secret)
+	return err == nil && subtle.ConstantTimeCompare([]byte(decoded), []byte(expected)) == 1
+}
+
+// clientSecret returns the secret of the app with the given client ID
+func (h *OIDCHandler) clientSecret(clientID string) (string, error) {
+	var app models.App
+	if err := h.db.Where("app_id = ?", clientID).First(&app).Error; err != nil {
+		return "", err
+	}
+	return app.SecretKey, nil
+}
+
+// audit records an OIDC audit log entry for a user and app
+func (h *OIDCHandler) audit(c *gin.Context, action string, user *models.User, appID, details string) {
+	auditLog := models.AuditLog{
+		ActionType: action,
+		TargetType: "APP",
+		TargetID:   appID,
+		OperatorID: models.AuditOperator(user.ID),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    details,
+	}
+	h.db.Create(&auditLog)
+}
+
+// oauthError writes an RFC 6749 error response
+func oauthError(c *gin.Context, status int, code, description string) {
+	body := gin.H{"error": code}
+	if description != "" {
+		body["error_description"] = description
+	}
+	c.JSON(status, body)
+}
+
+// authorizeErrorRedirect builds the client redirect carrying an authorization error
+func authorizeErrorRedirect(req *AuthorizeRequest, code, description string) string {
+	params := url.Values{"error": {code}, "error_description": {description}}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	return withQuery(req.RedirectURI, params)
+}
+
+// withQuery adds query parameters to a URL, keeping any it already has
+func withQuery(rawURL string, params url.Values) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// parseScope returns the supported scopes of a space separated scope string
+func parseScope(scope string) []string {
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		if containsString(oidcScopes, s) && !containsString(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// hasScope reports whether a space separated scope string contains a scope
+func hasScope(scope, name string) bool {
+	return containsString(strings.Fields(scope), name)
+}
+
+// decodeStringList decodes a JSON array column, treating empty or invalid values as empty
+func decodeStringList(value string) []string {
+	var list []string
+	if value != "" {
+		json.Unmarshal([]byte(value), &list)
+	}
+	return list
+}
+
+// encodeStringList encodes a list for a JSON array column
+func encodeStringList(list []string) string {
+	if list == nil {
+		list = []string{}
+	}
+	encoded, _ := json.Marshal(list)
+	return string(encoded)
+}
+
+// validateRedirectURIs checks that every URI is absolute and has no fragment
+func validateRedirectURIs(uris []string) error {
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+			return fmt.Errorf("invalid redirect URI %q", uri)
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
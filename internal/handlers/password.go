@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"tounetcore/internal/auth"
+	"tounetcore/internal/config"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	passwordPolicyOnce sync.Once
+	policy             *auth.PasswordPolicy
+)
+
+// passwordPolicy returns the configured password policy, loading the denylist on first use
+func passwordPolicy(cfg *config.Config) *auth.PasswordPolicy {
+	passwordPolicyOnce.Do(func() {
+		policy = &auth.PasswordPolicy{
+			MinLength:     cfg.PasswordMinLength,
+			RequireUpper:  cfg.PasswordRequireUpper,
+			RequireLower:  cfg.PasswordRequireLower,
+			RequireDigit:  cfg.PasswordRequireDigit,
+			RequireSymbol: cfg.PasswordRequireSymbol,
+			HistorySize:   cfg.PasswordHistorySize,
+		}
+		if cfg.PasswordDenylistFile != "" {
+			if err := policy.LoadDenylist(cfg.PasswordDenylistFile); err != nil {
+				log.Printf("Failed to load password denylist %s: %v", cfg.PasswordDenylistFile, err)
+			}
+		}
+	})
+	return policy
+}
+
+// validateNewPassword checks a password against the policy and, for existing users, their recent passwords
+func validateNewPassword(db *gorm.DB, cfg *config.Config, user *models.User, password string) error {
+	p := passwordPolicy(cfg)
+	if err := p.Validate(password, user.Username); err != nil {
+		return err
+	}
+
+	if user.ID == 0 || p.HistorySize <= 0 {
+		return nil
+	}
+
+	if user.PasswordHash != "" && auth.CheckPassword(password, user.PasswordHash) {
+		return &auth.PasswordPolicyError{Reason: "password was used recently"}
+	}
+
+	var history []models.PasswordHistory
+	db.Where("user_id = ?", user.ID).Order("created_at DESC").Limit(p.HistorySize).Find(&history)
+	for _, entry := range history {
+		if auth.CheckPassword(password, entry.PasswordHash) {
+			return &auth.PasswordPolicyError{Reason: "password was used recently"}
+		}
+	}
+
+	return nil
+}
+
+// recordPasswordHistory stores a password hash and prunes entries beyond the history size
+func recordPasswordHistory(db *gorm.DB, cfg *config.Config, userID uint, passwordHash string) {
+	if cfg.PasswordHistorySize <= 0 {
+		return
+	}
+
+	db.Create(&models.PasswordHistory{UserID: userID, PasswordHash: passwordHash})
+
+	var keep []uint
+	db.Model(&models.PasswordHistory{}).Where("user_id = ?", userID).
+		Order("created_at DESC").Limit(cfg.PasswordHistorySize).Pluck("id", &keep)
+	if len(keep) > 0 {
+		db.Where("user_id = ? AND id NOT IN ?", userID, keep).Delete(&models.PasswordHistory{})
+	}
+}
+
+// respondPasswordError maps a password validation error to a response
+func respondPasswordError(c *gin.Context, err error) {
+	var policyErr *auth.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": policyErr.Reason,
+		})
+		return
+	}
+
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"code":    500,
+		"message": "failed to validate password",
+	})
+}
@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"tounetcore/internal/auth"
+	"tounetcore/internal/config"
+	"tounetcore/internal/middleware"
+	"tounetcore/internal/models"
+	"tounetcore/internal/notify"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// resetCodeDigits is the length of password reset codes
+	resetCodeDigits = 6
+	// resetMaxAttempts is the number of wrong guesses allowed per reset code
+	resetMaxAttempts = 5
+	// resetMaxPerIPPerHour limits reset requests from a single client IP
+	resetMaxPerIPPerHour = 10
+)
+
+type PasswordResetHandler struct {
+	db       *gorm.DB
+	cfg      *config.Config
+	notifier *notify.Dispatcher
+}
+
+func NewPasswordResetHandler(db *gorm.DB, cfg *config.Config) *PasswordResetHandler {
+	return &PasswordResetHandler{db: db, cfg: cfg, notifier: notify.NewDispatcher(cfg)}
+}
+
+// PasswordResetRequest represents a request for a password reset code
+type PasswordResetRequest struct {
+	Username string `json:"username" binding:"required"`
+	Channel  string `json:"channel"` // defaults to the user's notification channel
+}
+
+// PasswordResetConfirmRequest represents a password reset confirmation
+type PasswordResetConfirmRequest struct {
+	Username    string `json:"username" binding:"required"`
+	Code        string `json:"code" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+}
+
+// RequestReset issues a reset code over the user's notification channel.
+// The response is the same whether or not the account exists.
+func (h *PasswordResetHandler) RequestReset(c *gin.Context) {
+	var req PasswordResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
+		})
+		return
+	}
+
+	accepted := gin.H{
+		"code":    200,
+		"message": "if the account exists and has a delivery channel, a reset code has been sent",
+	}
+
+	// Per-IP rate limit, counted before the lookup so it applies whether or not the account exists
+	if attempts := recordAttempt(h.db, resetIPThrottleKey(c.ClientIP()), time.Hour); attempts > resetMaxPerIPPerHour {
+		if attempts == resetMaxPerIPPerHour+1 {
+			auditLog := models.AuditLog{
+				ActionType: "PASSWORD_RESET_RATE_LIMITED",
+				TargetType: "IP",
+				TargetID:   c.ClientIP(),
+				IPAddress:  c.ClientIP(),
+				UserAgent:  c.GetHeader("User-Agent"),
+				Details:    fmt.Sprintf("Client IP %s exceeded %d password reset requests per hour", c.ClientIP(), resetMaxPerIPPerHour),
+			}
+			h.db.Create(&auditLog)
+		}
+		respondThrottled(c, time.Hour, false)
+		return
+	}
+
+	// Requests that send no code still pay for hashing one, so response timing
+	// does not reveal whether the account exists
+	var user models.User
+	if err := h.db.Where("username = ?", req.Username).First(&user).Error; err != nil {
+		auth.CheckPasswordDummy(req.Username)
+		c.JSON(http.StatusOK, accepted)
+		return
+	}
+
+	notifier := h.selectNotifier(&user, req.Channel)
+	if notifier == nil {
+		auth.CheckPasswordDummy(req.Username)
+		c.JSON(http.StatusOK, accepted)
+		return
+	}
+
+	// Per-user rate limit, silently ignored so it does not reveal the account
+	var recentForUser int64
+	h.db.Model(&models.PasswordReset{}).
+		Where("user_id = ? AND created_at > ?", user.ID, time.Now().Add(-time.Hour)).
+		Count(&recentForUser)
+	if recentForUser >= int64(h.cfg.PasswordResetMaxPerHour) {
+		h.audit(c, "PASSWORD_RESET_RATE_LIMITED", &user, "Password reset request rate limited")
+		auth.CheckPasswordDummy(req.Username)
+		c.JSON(http.StatusOK, accepted)
+		return
+	}
+
+	code, err := auth.GenerateNumericCode(resetCodeDigits)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to generate code",
+		})
+		return
+	}
+	codeHash, err := auth.HashPassword(code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to generate code",
+		})
+		return
+	}
+
+	reset := models.PasswordReset{
+		UserID:    user.ID,
+		CodeHash:  codeHash,
+		Channel:   notifier.Name(),
+		ExpiresAt: time.Now().Add(h.cfg.PasswordResetExpiration),
+		IPAddress: c.ClientIP(),
+	}
+	msg := notify.Message{
+		Title: "TouNetCore password reset",
+		Body:  fmt.Sprintf("Your password reset code is %s", code),
+	}
+
+	// Delivery goes through the outbox so it does not add to the response time either
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		// Only the newest code is valid
+		if err := tx.Model(&models.PasswordReset{}).
+			Where("user_id = ? AND used_at IS NULL", user.ID).
+			Update("expires_at", time.Now()).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&reset).Error; err != nil {
+			return err
+		}
+		return notify.Enqueue(tx, user.ID, "password_reset", notifier.Name(), msg)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to create reset",
+		})
+		return
+	}
+
+	h.audit(c, "PASSWORD_RESET_REQUESTED", &user, fmt.Sprintf("Password reset code sent via %s", notifier.Name()))
+
+	c.JSON(http.StatusOK, accepted)
+}
+
+// ConfirmReset sets a new password using a valid reset code
+func (h *PasswordResetHandler) ConfirmReset(c *gin.Context) {
+	var req PasswordResetConfirmRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
+		})
+		return
+	}
+
+	invalid := gin.H{
+		"code":    400,
+		"message": "invalid or expired reset code",
+	}
+
+	// Wrong codes count towards the client IP's login lockout
+	if wait, locked := checkLoginThrottle(h.db, h.cfg, ipThrottleKey(c.ClientIP())); wait > 0 {
+		respondThrottled(c, wait, locked)
+		return
+	}
+
+	var user models.User
+	if err := h.db.Where("username = ?", req.Username).First(&user).Error; err != nil {
+		auth.CheckPasswordDummy(req.Code)
+		recordLoginFailure(h.db, h.cfg, ipThrottleKey(c.ClientIP()), h.cfg.LoginIPMaxFailures)
+		c.JSON(http.StatusBadRequest, invalid)
+		return
+	}
+
+	var reset models.PasswordReset
+	if err := h.db.Where("user_id = ? AND used_at IS NULL AND expires_at > ? AND attempts < ?", user.ID, time.Now(), resetMaxAttempts).
+		Order("created_at DESC").First(&reset).Error; err != nil {
+		auth.CheckPasswordDummy(req.Code)
+		recordLoginFailure(h.db, h.cfg, ipThrottleKey(c.ClientIP()), h.cfg.LoginIPMaxFailures)
+		c.JSON(http.StatusBadRequest, invalid)
+		return
+	}
+
+	if !auth.CheckPassword(strings.TrimSpace(req.Code), reset.CodeHash) {
+		h.db.Model(&reset).Update("attempts", gorm.Expr("attempts + 1"))
+		recordLoginFailure(h.db, h.cfg, ipThrottleKey(c.ClientIP()), h.cfg.LoginIPMaxFailures)
+		h.audit(c, "PASSWORD_RESET_FAILED", &user, "Wrong password reset code")
+		c.JSON(http.StatusBadRequest, invalid)
+		return
+	}
+
+	if err := validateNewPassword(h.db, h.cfg, &user, req.NewPassword); err != nil {
+		respondPasswordError(c, err)
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to hash password",
+		})
+		return
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		// Consume the code atomically so it cannot be used twice
+		result := tx.Model(&models.PasswordReset{}).
+			Where("id = ? AND used_at IS NULL", reset.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return errors.New("reset code already used")
+		}
+		return tx.Model(&user).Update("password_hash", hashedPassword).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, invalid)
+		return
+	}
+
+	recordPasswordHistory(h.db, h.cfg, user.ID, hashedPassword)
+	revokeUserSessions(h.db, user.ID)
+	resetLoginFailures(h.db, usernameThrottleKey(user.Username))
+	middleware.InvalidateUser(user.ID)
+
+	h.audit(c, "PASSWORD_RESET_COMPLETED", &user, fmt.Sprintf("Password reset via %s code", reset.Channel))
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
+
+// selectNotifier picks the requested channel, or the user's preferred channel with
+// fallback. The log channel is never used for reset codes outside development.
+func (h *PasswordResetHandler) selectNotifier(user *models.User, channel string) notify.Notifier {
+	recipient := notify.RecipientFromUser(user)
+
+	var notifier notify.Notifier
+	if channel != "" {
+		n, err := h.notifier.Resolve(channel, recipient)
+		if err != nil || n.Name() != channel {
+			return nil
+		}
+		notifier = n
+	} else {
+		// Users who opted out of notifications still asked for this code
+		preferred := user.NotifyChannel
+		if preferred == "none" {
+			preferred = ""
+		}
+		n, err := h.notifier.Resolve(preferred, recipient)
+		if err != nil {
+			return nil
+		}
+		notifier = n
+	}
+
+	if notifier.Name() == "log" && h.cfg.Environment != "development" {
+		return nil
+	}
+	return notifier
+}
+
+// audit records a password reset audit log entry
+func (h *PasswordResetHandler) audit(c *gin.Context, action string, user *models.User, details string) {
+	auditLog := models.AuditLog{
+		ActionType: action,
+		TargetType: "USER",
+		TargetID:   fmt.Sprintf("%d", user.ID),
+		OperatorID: models.AuditOperator(user.ID),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("%s for user %s", details, user.Username),
+	}
+	h.db.Create(&auditLog)
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tounetcore/internal/middleware"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Requests for unknown usernames count towards the per-IP limit like any other
+func TestRequestResetLimitsUnknownUsernamesPerIP(t *testing.T) {
+	db := newTestDB(t)
+	h := NewPasswordResetHandler(db, newTestConfig(t))
+	r := gin.New()
+	r.POST("/password/reset", h.RequestReset)
+
+	for i := 0; i < resetMaxPerIPPerHour; i++ {
+		body := []byte(fmt.Sprintf(`{"username":"nobody%d"}`, i))
+		if status, out := doJSON(t, r, http.MethodPost, "/password/reset", body); status != http.StatusOK {
+			t.Fatalf("request %d: status %d: %v", i, status, out)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if status, out := doJSON(t, r, http.MethodPost, "/password/reset", []byte(`{"username":"nobody"}`)); status != http.StatusTooManyRequests {
+			t.Fatalf("over the limit: status %d, want 429: %v", status, out)
+		}
+	}
+
+	var audits int64
+	db.Model(&models.AuditLog{}).Where("action_type = ? AND target_type = ?", "PASSWORD_RESET_RATE_LIMITED", "IP").Count(&audits)
+	if audits != 1 {
+		t.Fatalf("%d rate limit audits, want 1", audits)
+	}
+}
+
+// A forged X-Forwarded-For on each request must not start a new per-IP count
+func TestRequestResetIgnoresForgedForwardedFor(t *testing.T) {
+	db := newTestDB(t)
+	cfg := newTestConfig(t)
+	r, err := middleware.NewEngine(cfg)
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+	h := NewPasswordResetHandler(db, cfg)
+	r.POST("/password/reset", h.RequestReset)
+
+	request := func(i int) int {
+		body := []byte(fmt.Sprintf(`{"username":"nobody%d"}`, i))
+		req := httptest.NewRequest(http.MethodPost, "/password/reset", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d", i+1))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < resetMaxPerIPPerHour; i++ {
+		if status := request(i); status != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, status)
+		}
+	}
+	if status := request(resetMaxPerIPPerHour); status != http.StatusTooManyRequests {
+		t.Fatalf("over the limit with a forged address: status %d, want 429", status)
+	}
+
+	var auditLog models.AuditLog
+	if err := db.Where("action_type = ?", "PASSWORD_RESET_RATE_LIMITED").First(&auditLog).Error; err != nil {
+		t.Fatalf("rate limit not audited: %v", err)
+	}
+	if auditLog.TargetID != "192.0.2.1" {
+		t.Fatalf("audited address %q, want the connection's 192.0.2.1", auditLog.TargetID)
+	}
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"tounetcore/internal/auth"
+	"tounetcore/internal/config"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ProxyRoute maps requests by host and/or path prefix to an app. Requests are
+// forwarded to the app's URL, which is looked up on every request.
+type ProxyRoute struct {
+	Host        string `json:"host"`
+	PathPrefix  string `json:"path_prefix"`
+	AppID       string `json:"app_id"`
+	StripPrefix bool   `json:"strip_prefix"` // remove path_prefix before forwarding
+}
+
+// ProxyHandler is an authenticating reverse proxy in front of app URLs
+type ProxyHandler struct {
+	db     *gorm.DB
+	cfg    *config.Config
+	keys   *auth.KeySet
+	routes []ProxyRoute
+}
+
+// NewProxyHandler loads the route table from the PROXY_ROUTES_FILE JSON file
+func NewProxyHandler(db *gorm.DB, cfg *config.Config, keys *auth.KeySet) (*ProxyHandler, error) {
+	data, err := os.ReadFile(cfg.ProxyRoutesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []ProxyRoute
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.ProxyRoutesFile, err)
+	}
+	for i, route := range routes {
+		if route.AppID == "" || (route.Host == "" && route.PathPrefix == "") {
+			return nil, fmt.Errorf("%s: route %d needs an app_id and a host or path_prefix", cfg.ProxyRoutesFile, i)
+		}
+	}
+
+	return &ProxyHandler{db: db, cfg: cfg, keys: keys, routes: routes}, nil
+}
+
+// Proxy authorizes the request for the routed app and forwards it with identity headers
+func (h *ProxyHandler) Proxy(c *gin.Context) {
+	route := h.match(c.Request.Host, c.Request.URL.Path)
+	if route == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "no route for request",
+		})
+		return
+	}
+
+	var app models.App
+	if err := h.db.Where("app_id = ?", route.AppID).First(&app).Error; err != nil || !app.IsActive {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code":    403,
+			"message": "app is inactive",
+		})
+		return
+	}
+	target, err := url.Parse(app.URL)
+	if err != nil || !target.IsAbs() {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"code":    502,
+			"message": "app has no valid url",
+		})
+		return
+	}
+
+	user, message := requestUser(c, h.db, h.cfg, h.keys, app.AppID)
+	if user == nil {
+		h.deny(c, http.StatusUnauthorized, message)
+		return
+	}
+	if !userHasAppPermission(h.db, user.ID, user.Status, &app) {
+		h.deny(c, http.StatusForbidden, "no permission for app")
+		return
+	}
+
+	// NKeys are TouNetCore credentials and are not passed on to the app
+	token := bearerToken(c.Request)
+	stripAuthorization := token != "" && isNKey(h.db, token)
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			if route.StripPrefix {
+				prefix := strings.TrimSuffix(route.PathPrefix, "/")
+				r.Out.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.Out.URL.Path, prefix), "/")
+				r.Out.URL.RawPath = ""
+			}
+			r.SetURL(target)
+			r.SetXForwarded()
+
+			// Only TouNetCore may assert who the user is
+			for name := range r.Out.Header {
+				if strings.HasPrefix(strings.ToLower(name), "x-auth-") {
+					r.Out.Header.Del(name)
+				}
+			}
+			setIdentityHeaders(r.Out.Header, user, app.AppID)
+			removeCookie(r.Out, h.cfg.SessionCookieName)
+			removeCookie(r.Out, nkeyCookieName)
+			if stripAuthorization {
+				r.Out.Header.Del("Authorization")
+			}
+		},
+		// Flush immediately so streamed responses are not buffered
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Proxy error for app %s: %v", app.AppID, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// match returns the most specific route for a request: host routes beat path-only
+// routes, then the longest path prefix wins
+func (h *ProxyHandler) match(host, path string) *ProxyRoute {
+	var best *ProxyRoute
+	bestScore := -1
+	for i := range h.routes {
+		route := &h.routes[i]
+		if route.Host != "" && !sameHost(route.Host, host) {
+			continue
+		}
+		prefix := strings.TrimSuffix(route.PathPrefix, "/")
+		if prefix != "" && path != prefix && !strings.HasPrefix(path, prefix+"/") {
+			continue
+		}
+
+		score := len(prefix)
+		if route.Host != "" {
+			score += 1 << 16
+		}
+		if score > bestScore {
+			best, bestScore = route, score
+		}
+	}
+	return best
+}
+
+// deny sends browsers to the login page and answers other clients with JSON
+func (h *ProxyHandler) deny(c *gin.Context, status int, message string) {
+	scheme := c.GetHeader("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = "http"
+	}
+	loginURL := withQuery(h.cfg.ForwardAuthLoginURL, url.Values{"rd": {fmt.Sprintf("%s://%s%s", scheme, c.Request.Host, c.Request.URL.RequestURI())}})
+
+	if status == http.StatusUnauthorized && c.Request.Method == http.MethodGet && strings.Contains(c.GetHeader("Accept"), "text/html") {
+		c.Redirect(http.StatusFound, loginURL)
+		return
+	}
+
+	c.JSON(status, gin.H{
+		"code":    status,
+		"message": message,
+		"data":    gin.H{"login_url": loginURL},
+	})
+}
+
+// removeCookie drops a cookie from a request so it is not forwarded upstream,
+// leaving the other cookies exactly as the client sent them
+func removeCookie(r *http.Request, name string) {
+	var kept []string
+	for _, line := range r.Header.Values("Cookie") {
+		for _, pair := range strings.Split(line, ";") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" || strings.SplitN(pair, "=", 2)[0] == name {
+				continue
+			}
+			kept = append(kept, pair)
+		}
+	}
+	r.Header.Del("Cookie")
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
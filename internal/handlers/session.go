@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"time"
+	"tounetcore/internal/auth"
+	"tounetcore/internal/config"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// createSession stores a new refresh token in the given family and returns the plain token.
+// clientID and scope are set for sessions issued to OIDC clients.
+func createSession(db *gorm.DB, cfg *config.Config, c *gin.Context, userID uint, familyID, clientID, scope string) (string, error) {
+	refreshToken, err := auth.GenerateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	session := models.Session{
+		UserID:           userID,
+		FamilyID:         familyID,
+		ClientID:         clientID,
+		Scope:            scope,
+		RefreshTokenHash: auth.HashToken(refreshToken),
+		ExpiresAt:        time.Now().Add(cfg.RefreshTokenExpiration),
+		IPAddress:        c.ClientIP(),
+		UserAgent:        c.GetHeader("User-Agent"),
+	}
+	if err := db.Create(&session).Error; err != nil {
+		return "", err
+	}
+
+	return refreshToken, nil
+}
+
+// issueTokens starts a new session family for the user and returns the token response data
+func issueTokens(db *gorm.DB, cfg *config.Config, keys *auth.KeySet, c *gin.Context, user *models.User) (gin.H, error) {
+	familyID, err := auth.GenerateSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := createSession(db, cfg, c, user.ID, familyID, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	return tokenResponse(cfg, keys, user, familyID, refreshToken)
+}
+
+// rotateSession marks a refresh token as used and issues its successor in the same family.
+// reused is set when the token was already rotated or revoked, meaning it is being replayed.
+func rotateSession(db *gorm.DB, cfg *config.Config, c *gin.Context, session *models.Session) (refreshToken string, reused bool, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Session{}).
+			Where("id = ? AND rotated_at IS NULL AND revoked_at IS NULL", session.ID).
+			Update("rotated_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			reused = true
+			return nil
+		}
+
+		var err error
+		refreshToken, err = createSession(tx, cfg, c, session.UserID, session.FamilyID, session.ClientID, session.Scope)
+		return err
+	})
+	return refreshToken, reused, err
+}
+
+// tokenResponse signs an access token for the session family and builds the response data
+func tokenResponse(cfg *config.Config, keys *auth.KeySet, user *models.User, familyID, refreshToken string) (gin.H, error) {
+	token, err := auth.GenerateJWT(user, familyID, keys, cfg.JWTExpiration)
+	if err != nil {
+		return nil, err
+	}
+
+	return gin.H{
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int(cfg.JWTExpiration.Seconds()),
+	}, nil
+}
+
+// revokeSessionFamily revokes every refresh token in a session family
+func revokeSessionFamily(db *gorm.DB, familyID string) error {
+	return db.Model(&models.Session{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// revokeUserSessions revokes every session of a user, invalidating their refresh and access tokens
+func revokeUserSessions(db *gorm.DB, userID uint) error {
+	return db.Model(&models.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// revokeOtherSessions revokes every session of a user except the given family
+func revokeOtherSessions(db *gorm.DB, userID uint, keepFamilyID string) error {
+	return db.Model(&models.Session{}).
+		Where("user_id = ? AND family_id != ? AND revoked_at IS NULL", userID, keepFamilyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// revokeAccessToken adds an access token to the revocation list until it expires
+func revokeAccessToken(db *gorm.DB, tokenID string, userID uint, expiresAt time.Time) error {
+	// Expired entries no longer need to be tracked
+	db.Where("expires_at < ?", time.Now()).Delete(&models.RevokedToken{})
+
+	return db.Create(&models.RevokedToken{
+		JTI:       tokenID,
+		UserID:    userID,
+		ExpiresAt: expiresAt,
+	}).Error
+}
@@ -0,0 +1,360 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"tounetcore/internal/auth"
+	"tounetcore/internal/config"
+	"tounetcore/internal/middleware"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ssoLoginPath is the hosted login page
+const ssoLoginPath = "/sso/login"
+
+// totpCodePattern tells TOTP codes apart from recovery codes on the login form
+var totpCodePattern = regexp.MustCompile(`^[0-9]{6}$`)
+
+var ssoLoginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>TouNetCore</title>
+<style>
+body { font-family: sans-serif; max-width: 22rem; margin: 4rem auto; padding: 0 1rem; }
+label, input, button { display: block; width: 100%; box-sizing: border-box; }
+input { margin: 0.25rem 0 1rem; padding: 0.5rem; }
+button { padding: 0.5rem; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+<h1>TouNetCore</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .User}}
+<p>Signed in as <strong>{{.User.Username}}</strong></p>
+<ul>
+{{range .Apps}}<li><a href="/sso/launch/{{.AppID}}">{{.Name}}</a></li>
+{{else}}<li>No apps available</li>
+{{end}}</ul>
+<form method="post" action="/sso/logout"><button type="submit">Sign out</button></form>
+{{else}}
+<form method="post" action="/sso/login">
+<input type="hidden" name="rd" value="{{.RD}}">
+<label>Username <input name="username" autocomplete="username" required autofocus></label>
+<label>Password <input name="password" type="password" autocomplete="current-password" required></label>
+<label>Authentication code (if 2FA is enabled) <input name="code" autocomplete="one-time-code"></label>
+<button type="submit">Sign in</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// ssoPage is the data rendered into the login page
+type ssoPage struct {
+	Error string
+	RD    string
+	User  *models.User
+	Apps  []models.App
+}
+
+// SSOHandler serves the hosted login page and launches apps from the browser SSO session
+type SSOHandler struct {
+	db    *gorm.DB
+	cfg   *config.Config
+	keys  *auth.KeySet
+	users *UserHandler
+}
+
+func NewSSOHandler(db *gorm.DB, cfg *config.Config, keys *auth.KeySet) *SSOHandler {
+	return &SSOHandler{db: db, cfg: cfg, keys: keys, users: NewUserHandler(db, cfg, keys)}
+}
+
+// LoginPage shows the login form, or the launchable apps when already signed in.
+// Signed-in users are sent straight on to an allowed rd target.
+func (h *SSOHandler) LoginPage(c *gin.Context) {
+	rd := c.Query("rd")
+	if !h.allowedRedirect(rd) {
+		rd = ""
+	}
+
+	user := sessionUser(c, h.db, h.cfg, h.keys)
+	if user != nil && rd != "" {
+		c.Redirect(http.StatusFound, rd)
+		return
+	}
+
+	page := ssoPage{RD: rd, User: user}
+	if user != nil {
+		page.Apps = h.launchableApps(user)
+	}
+	h.render(c, http.StatusOK, page)
+}
+
+// Login checks the submitted credentials, sets the SSO session cookie and redirects to rd
+func (h *SSOHandler) Login(c *gin.Context) {
+	if !h.sameOrigin(c) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code":    403,
+			"message": "cross-origin request rejected",
+		})
+		return
+	}
+
+	rd := c.PostForm("rd")
+	if !h.allowedRedirect(rd) {
+		rd = ""
+	}
+	username := c.PostForm("username")
+	password := c.PostForm("password")
+	page := ssoPage{RD: rd}
+
+	// Reject attempts that arrive during a progressive delay or lockout
+	if wait, _ := checkLoginThrottle(h.db, h.cfg, usernameThrottleKey(username), ipThrottleKey(c.ClientIP())); wait > 0 {
+		c.Header("Retry-After", fmt.Sprintf("%d", int(wait.Seconds()+0.5)))
+		page.Error = "Too many failed attempts. Try again later."
+		h.render(c, http.StatusTooManyRequests, page)
+		return
+	}
+
+	var user models.User
+	if err := h.db.Where("username = ?", username).First(&user).Error; err != nil {
+		// Spend the same bcrypt time as a wrong password so usernames cannot be probed
+		auth.CheckPasswordDummy(password)
+		recordFailedLogin(h.db, h.cfg, c, username, 0)
+		page.Error = "Invalid username or password."
+		h.render(c, http.StatusUnauthorized, page)
+		return
+	}
+	if !auth.CheckPassword(password, user.PasswordHash) {
+		recordFailedLogin(h.db, h.cfg, c, username, user.ID)
+		page.Error = "Invalid username or password."
+		h.render(c, http.StatusUnauthorized, page)
+		return
+	}
+
+	if user.MFAEnabled() {
+		// Passkeys need a WebAuthn ceremony, which this page does not run
+		if !user.TOTPEnabled {
+			page.Error = "This account signs in with a passkey. Use the TouNetCore app to sign in."
+			h.render(c, http.StatusUnauthorized, page)
+			return
+		}
+
+		code := strings.TrimSpace(c.PostForm("code"))
+		if code == "" {
+			page.Error = "Enter the code from your authenticator app or a recovery code."
+			h.render(c, http.StatusUnauthorized, page)
+			return
+		}
+
+		var verified bool
+		if totpCodePattern.MatchString(code) {
+			verified = h.users.verifySecondFactor(&user, code, "")
+		} else {
+			verified = h.users.verifySecondFactor(&user, "", code)
+		}
+		if !verified {
+			recordFailedLogin(h.db, h.cfg, c, username, user.ID)
+			page.Error = "Invalid authentication code."
+			h.render(c, http.StatusUnauthorized, page)
+			return
+		}
+	} else if middleware.MFARequired(h.cfg, user.Status) {
+		page.Error = "Set up two-factor authentication in the TouNetCore app before using single sign-on."
+		h.render(c, http.StatusForbidden, page)
+		return
+	}
+
+	// The SSO session is a session family without a usable refresh token, so it shows
+	// up in the user's session list and is revoked by logout-all and password changes
+	var token string
+	err := h.users.beginSession(c, &user, func(tx *gorm.DB) error {
+		familyID, err := auth.GenerateSessionID()
+		if err != nil {
+			return err
+		}
+		if _, err := createSession(tx, h.cfg, c, user.ID, familyID, "", ""); err != nil {
+			return err
+		}
+		token, err = auth.GenerateSSOToken(&user, familyID, h.keys, h.cfg.SSOSessionExpiration)
+		return err
+	})
+	if err != nil {
+		page.Error = "Sign-in failed. Please try again."
+		h.render(c, http.StatusInternalServerError, page)
+		return
+	}
+
+	h.setCookie(c, h.cfg.SessionCookieName, token, int(h.cfg.SSOSessionExpiration.Seconds()))
+
+	if rd == "" {
+		rd = ssoLoginPath
+	}
+	c.Redirect(http.StatusSeeOther, rd)
+}
+
+// Logout ends the SSO session and clears its cookie
+func (h *SSOHandler) Logout(c *gin.Context) {
+	if !h.sameOrigin(c) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code":    403,
+			"message": "cross-origin request rejected",
+		})
+		return
+	}
+
+	h.endSession(c)
+	c.Redirect(http.StatusSeeOther, ssoLoginPath)
+}
+
+// endSession revokes the SSO session in the request's cookie and clears the cookie
+func (h *SSOHandler) endSession(c *gin.Context) {
+	if token, err := c.Cookie(h.cfg.SessionCookieName); err == nil {
+		if claims, err := auth.ValidateSSOToken(token, h.keys); err == nil {
+			revokeSessionFamily(h.db, claims.SessionID)
+		}
+	}
+	h.setCookie(c, h.cfg.SessionCookieName, "", -1)
+}
+
+// Launch mints an NKey for the app from the SSO session and redirects to the app's URL with it
+func (h *SSOHandler) Launch(c *gin.Context) {
+	appID := c.Param("app_id")
+
+	user := sessionUser(c, h.db, h.cfg, h.keys)
+	if user == nil {
+		c.Redirect(http.StatusFound, withQuery(ssoLoginPath, url.Values{"rd": {"/sso/launch/" + url.PathEscape(appID)}}))
+		return
+	}
+
+	var app models.App
+	if err := h.db.Where("app_id = ? AND is_active = ?", appID, true).First(&app).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "app not found",
+		})
+		return
+	}
+	if app.URL == "" || !h.allowedRedirect(app.URL) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code":    403,
+			"message": "app url is not an allowed redirect target",
+		})
+		return
+	}
+
+	// The NKey goes straight to the app, so it is not also sent as a notification
+	nkey, _, nkeyErr := issueNKey(h.db, h.cfg, user, []string{app.AppID}, c.ClientIP(), false, false)
+	if nkeyErr != nil {
+		c.JSON(nkeyErr.status, gin.H{
+			"code":    nkeyErr.status,
+			"message": nkeyErr.message,
+		})
+		return
+	}
+
+	// Apps under the shared cookie domain can also read the NKey from the nkey cookie
+	if h.cfg.SessionCookieDomain != "" {
+		h.setCookie(c, nkeyCookieName, nkey, int(h.cfg.NKeyExpiration.Seconds()))
+	}
+
+	auditLog := models.AuditLog{
+		ActionType: "SSO_LAUNCH",
+		TargetType: "APP",
+		TargetID:   app.AppID,
+		OperatorID: models.AuditOperator(user.ID),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("User %s launched app %s", user.Username, app.AppID),
+	}
+	h.db.Create(&auditLog)
+
+	c.Redirect(http.StatusFound, withQuery(app.URL, url.Values{"nkey": {nkey}}))
+}
+
+// launchableApps lists the active apps with a URL that the user may launch
+func (h *SSOHandler) launchableApps(user *models.User) []models.App {
+	var apps []models.App
+	h.db.Where("is_active = ? AND url <> ''", true).Order("name").Find(&apps)
+
+	var result []models.App
+	for _, app := range apps {
+		if userHasAppPermission(h.db, user.ID, user.Status, &app) && h.allowedRedirect(app.URL) {
+			result = append(result, app)
+		}
+	}
+	return result
+}
+
+// allowedRedirect reports whether the browser may be sent to target: a path on this
+// server, or an http(s) URL whose host is in SSO_REDIRECT_HOSTS
+func (h *SSOHandler) allowedRedirect(target string) bool {
+	if target == "" {
+		return false
+	}
+	if strings.HasPrefix(target, "/") {
+		// "//host" and "/\host" are treated as other hosts by browsers
+		return !strings.HasPrefix(target, "//") && !strings.HasPrefix(target, "/\\")
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.User != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range h.cfg.SSORedirectHosts {
+		allowed = strings.ToLower(allowed)
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(host, allowed[1:]) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin rejects form posts made from other sites. Browsers send Origin on
+// cross-site POSTs, so a missing header means a same-site or non-browser request.
+func (h *SSOHandler) sameOrigin(c *gin.Context) bool {
+	origin := c.GetHeader("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && sameHost(u.Host, c.Request.Host)
+}
+
+// setCookie sets an HttpOnly cookie on the configured SSO cookie domain
+func (h *SSOHandler) setCookie(c *gin.Context, name, value string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   h.cfg.SessionCookieDomain,
+		MaxAge:   maxAge,
+		Secure:   h.cfg.SessionCookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// render writes the login page
+func (h *SSOHandler) render(c *gin.Context, status int, page ssoPage) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(status)
+	ssoLoginPage.Execute(c.Writer, page)
+}
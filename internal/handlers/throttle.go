@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+	"tounetcore/internal/config"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// loginFreeAttempts is the number of failures allowed before delays start
+	loginFreeAttempts = 3
+	// loginMaxDelay caps the progressive delay between attempts
+	loginMaxDelay = 30 * time.Second
+)
+
+// usernameThrottleKey returns the throttle key for a username
+func usernameThrottleKey(username string) string {
+	return "user:" + username
+}
+
+// ipThrottleKey returns the throttle key for a client IP
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// resetIPThrottleKey returns the key counting password reset requests from a client IP
+func resetIPThrottleKey(ip string) string {
+	return "reset-ip:" + ip
+}
+
+// loginDelay returns the progressive delay required after the given number of failures
+func loginDelay(failures int) time.Duration {
+	if failures < loginFreeAttempts {
+		return 0
+	}
+	delay := time.Second * time.Duration(math.Pow(2, float64(failures-loginFreeAttempts)))
+	if delay > loginMaxDelay {
+		return loginMaxDelay
+	}
+	return delay
+}
+
+// checkLoginThrottle returns how long the caller must wait before another attempt
+// for any of the keys, and whether that wait is due to a lockout
+func checkLoginThrottle(db *gorm.DB, cfg *config.Config, keys ...string) (time.Duration, bool) {
+	var throttles []models.LoginThrottle
+	db.Where("throttle_key IN ?", keys).Find(&throttles)
+
+	now := time.Now()
+	var wait time.Duration
+	locked := false
+	for _, t := range throttles {
+		if t.LockedUntil != nil && now.Before(*t.LockedUntil) {
+			if d := t.LockedUntil.Sub(now); d > wait || !locked {
+				wait = d
+			}
+			locked = true
+			continue
+		}
+		if locked || now.Sub(t.LastFailureAt) > cfg.LoginFailureWindow {
+			continue
+		}
+		if d := t.LastFailureAt.Add(loginDelay(t.Failures)).Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, locked
+}
+
+// recordLoginFailure counts a failed attempt against the key and locks it once the limit is reached.
+// It returns true when this failure caused a new lockout.
+func recordLoginFailure(db *gorm.DB, cfg *config.Config, key string, limit int) bool {
+	now := time.Now()
+
+	// Failures outside the window start a fresh count
+	db.Model(&models.LoginThrottle{}).
+		Where("throttle_key = ? AND last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)", key, now.Add(-cfg.LoginFailureWindow), now).
+		Updates(map[string]interface{}{"failures": 0, "locked_until": nil})
+
+	// Atomic increment so concurrent attempts are all counted
+	db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "throttle_key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"failures":        gorm.Expr("login_throttles.failures + 1"),
+			"last_failure_at": now,
+			"updated_at":      now,
+		}),
+	}).Create(&models.LoginThrottle{Key: key, Failures: 1, LastFailureAt: now})
+
+	result := db.Model(&models.LoginThrottle{}).
+		Where("throttle_key = ? AND failures >= ? AND (locked_until IS NULL OR locked_until < ?)", key, limit, now).
+		Update("locked_until", now.Add(cfg.LoginLockoutDuration))
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// recordAttempt counts an attempt against the key and returns the count within the window.
+// The count only starts over after a full window without attempts.
+func recordAttempt(db *gorm.DB, key string, window time.Duration) int {
+	now := time.Now()
+
+	db.Model(&models.LoginThrottle{}).
+		Where("throttle_key = ? AND last_failure_at < ?", key, now.Add(-window)).
+		Update("failures", 0)
+
+	db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "throttle_key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"failures":        gorm.Expr("login_throttles.failures + 1"),
+			"last_failure_at": now,
+			"updated_at":      now,
+		}),
+	}).Create(&models.LoginThrottle{Key: key, Failures: 1, LastFailureAt: now})
+
+	var throttle models.LoginThrottle
+	db.Where("throttle_key = ?", key).First(&throttle)
+	return throttle.Failures
+}
+
+// resetLoginFailures clears the failure count for a key after a successful login or admin unlock
+func resetLoginFailures(db *gorm.DB, key string) {
+	db.Where("throttle_key = ?", key).Delete(&models.LoginThrottle{})
+}
+
+// recordFailedLogin records a failed login for the username and client IP and audits new lockouts
+func recordFailedLogin(db *gorm.DB, cfg *config.Config, c *gin.Context, username string, userID uint) {
+	if recordLoginFailure(db, cfg, usernameThrottleKey(username), cfg.LoginMaxFailures) {
+		auditLog := models.AuditLog{
+			ActionType: "ACCOUNT_LOCKED",
+			TargetType: "USER",
+			TargetID:   username,
+			OperatorID: models.AuditOperator(userID),
+			IPAddress:  c.ClientIP(),
+			UserAgent:  c.GetHeader("User-Agent"),
+			Details:    fmt.Sprintf("Username %s locked for %s after %d failed logins", username, cfg.LoginLockoutDuration, cfg.LoginMaxFailures),
+		}
+		db.Create(&auditLog)
+	}
+
+	if recordLoginFailure(db, cfg, ipThrottleKey(c.ClientIP()), cfg.LoginIPMaxFailures) {
+		auditLog := models.AuditLog{
+			ActionType: "IP_LOCKED",
+			TargetType: "IP",
+			TargetID:   c.ClientIP(),
+			OperatorID: models.AuditOperator(userID),
+			IPAddress:  c.ClientIP(),
+			UserAgent:  c.GetHeader("User-Agent"),
+			Details:    fmt.Sprintf("Client IP %s locked for %s after %d failed logins", c.ClientIP(), cfg.LoginLockoutDuration, cfg.LoginIPMaxFailures),
+		}
+		db.Create(&auditLog)
+	}
+}
+
+// respondThrottled rejects a login attempt that arrived before the required wait
+func respondThrottled(c *gin.Context, wait time.Duration, locked bool) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	message := "too many failed attempts, retry later"
+	if locked {
+		message = "temporarily locked due to too many failed attempts"
+	}
+
+	c.Header("Retry-After", fmt.Sprintf("%d", seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"code":        429,
+		"message":     message,
+		"retry_after": seconds,
+	})
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tounetcore/internal/middleware"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Anonymous audit events have no operator and must still be stored where the
+// operator foreign key is enforced
+func TestAnonymousAuditEventsAreRecorded(t *testing.T) {
+	db := newTestDB(t)
+	cfg := newTestConfig(t)
+	cfg.LoginMaxFailures = 2
+	cfg.LoginIPMaxFailures = 2
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/api/v1/login", nil)
+
+	for i := 0; i < cfg.LoginMaxFailures; i++ {
+		recordFailedLogin(db, cfg, c, "nobody", 0)
+	}
+	middleware.LogAppAuthFailure(db, c, "unknown-app", "unknown app")
+
+	for _, action := range []string{"ACCOUNT_LOCKED", "IP_LOCKED", "APP_AUTH_FAILED"} {
+		var auditLog models.AuditLog
+		if err := db.Where("action_type = ?", action).First(&auditLog).Error; err != nil {
+			t.Fatalf("%s not audited: %v", action, err)
+		}
+		if auditLog.OperatorID != nil {
+			t.Fatalf("%s recorded operator %d, want none", action, *auditLog.OperatorID)
+		}
+	}
+}
+
+// X-Forwarded-For from a client that is not a trusted proxy must not give it a fresh
+// per-IP counter on every attempt
+func TestForgedForwardedForDoesNotResetIPThrottle(t *testing.T) {
+	db := newTestDB(t)
+	cfg := newTestConfig(t)
+	r, err := middleware.NewEngine(cfg)
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+	h := NewUserHandler(db, cfg, newTestKeys(t, cfg))
+	r.POST("/login", h.Login)
+
+	login := func(i int) int {
+		body := []byte(fmt.Sprintf(`{"username":"nobody%d","password":"wrong"}`, i))
+		req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d", i+1))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Every attempt uses a new username and a new forged address, so only the
+	// connection's IP links them
+	for i := 0; i < loginFreeAttempts; i++ {
+		if status := login(i); status != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status %d, want 401", i, status)
+		}
+	}
+	if status := login(loginFreeAttempts); status != http.StatusTooManyRequests {
+		t.Fatalf("attempt after %d failures: status %d, want 429", loginFreeAttempts, status)
+	}
+
+	var throttle models.LoginThrottle
+	if err := db.Where("throttle_key = ?", ipThrottleKey("192.0.2.1")).First(&throttle).Error; err != nil {
+		t.Fatalf("connection address not throttled: %v", err)
+	}
+	var forged int64
+	db.Model(&models.LoginThrottle{}).Where("throttle_key LIKE ?", ipThrottleKey("198.51.100.%")).Count(&forged)
+	if forged != 0 {
+		t.Fatalf("%d forged addresses throttled", forged)
+	}
+}
+
+// Behind a trusted proxy the forwarded address is the client's
+func TestTrustedProxyForwardsClientIP(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.TrustedProxies = []string{"192.0.2.0/24"}
+	r, err := middleware.NewEngine(cfg)
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+	r.GET("/ip", func(c *gin.Context) {
+		c.String(http.StatusOK, c.ClientIP())
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/ip", nil)
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Body.String() != "198.51.100.7" {
+		t.Fatalf("client IP %q, want the forwarded 198.51.100.7", w.Body.String())
+	}
+}
+
+// Guessing the current password on a password change is throttled like login
+func TestChangePasswordIsThrottled(t *testing.T) {
+	db := newTestDB(t)
+	cfg := newTestConfig(t)
+	user := createTestUser(t, db, "alice", models.StatusUser)
+	h := NewUserHandler(db, cfg, newTestKeys(t, cfg))
+	r := gin.New()
+	r.PUT("/password", asUser(user), func(c *gin.Context) {
+		c.Set("session_id", "current")
+		c.Next()
+	}, h.ChangePassword)
+
+	change := func(current string) int {
+		body := []byte(fmt.Sprintf(`{"current_password":%q,"new_password":"N3w-Passw0rd-alice"}`, current))
+		req := httptest.NewRequest(http.MethodPut, "/password", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < loginFreeAttempts; i++ {
+		if status := change("wrong"); status != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status %d, want 401", i+1, status)
+		}
+	}
+	if status := change("Passw0rd-alice"); status != http.StatusTooManyRequests {
+		t.Fatalf("attempt after %d failures: status %d, want 429", loginFreeAttempts, status)
+	}
+}
@@ -1,23 +1,30 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"net/mail"
+	"strings"
 	"time"
 	"tounetcore/internal/auth"
 	"tounetcore/internal/config"
+	"tounetcore/internal/middleware"
 	"tounetcore/internal/models"
+	"tounetcore/internal/notify"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 type UserHandler struct {
-	db  *gorm.DB
-	cfg *config.Config
+	db   *gorm.DB
+	cfg  *config.Config
+	keys *auth.KeySet
 }
 
-func NewUserHandler(db *gorm.DB, cfg *config.Config) *UserHandler {
-	return &UserHandler{db: db, cfg: cfg}
+func NewUserHandler(db *gorm.DB, cfg *config.Config, keys *auth.KeySet) *UserHandler {
+	return &UserHandler{db: db, cfg: cfg, keys: keys}
 }
 
 // RegisterRequest represents user registration request
@@ -35,10 +42,24 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
+// RefreshTokenRequest represents token refresh request
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// ChangePasswordRequest represents a self-service password change request
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
 // UpdateUserRequest represents user update request
 type UpdateUserRequest struct {
 	Phone         string `json:"phone"`
 	PushDeerToken string `json:"pushdeer_token"`
+	Email         string `json:"email"`
+	WebhookURL    string `json:"webhook_url"`
+	NotifyChannel string `json:"notify_channel"`
 }
 
 // Register handles user registration
@@ -73,6 +94,12 @@ func (h *UserHandler) Register(c *gin.Context) {
 		return
 	}
 
+	// Enforce password policy
+	if err := validateNewPassword(h.db, h.cfg, &models.User{Username: req.Username}, req.Password); err != nil {
+		respondPasswordError(c, err)
+		return
+	}
+
 	// Hash password
 	hashedPassword, err := auth.HashPassword(req.Password)
 	if err != nil {
@@ -100,14 +127,16 @@ func (h *UserHandler) Register(c *gin.Context) {
 		return
 	}
 
+	recordPasswordHistory(h.db, h.cfg, user.ID, user.PasswordHash)
+
 	// Mark invite code as used
 	now := time.Now()
 	inviteCode.CodeUserID = &user.ID
 	inviteCode.UsedAt = &now
 	h.db.Save(&inviteCode)
 
-	// Generate JWT token
-	token, err := auth.GenerateJWT(&user, h.cfg.JWTSecret, h.cfg.JWTExpiration)
+	// Start a session and generate tokens
+	data, err := issueTokens(h.db, h.cfg, h.keys, c, &user)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    500,
@@ -115,14 +144,12 @@ func (h *UserHandler) Register(c *gin.Context) {
 		})
 		return
 	}
+	data["user_id"] = user.ID
 
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
 		"message": "success",
-		"data": gin.H{
-			"user_id": user.ID,
-			"token":   token,
-		},
+		"data":    data,
 	})
 }
 
@@ -137,9 +164,18 @@ func (h *UserHandler) Login(c *gin.Context) {
 		return
 	}
 
+	// Reject attempts that arrive during a progressive delay or lockout
+	if wait, locked := checkLoginThrottle(h.db, h.cfg, usernameThrottleKey(req.Username), ipThrottleKey(c.ClientIP())); wait > 0 {
+		respondThrottled(c, wait, locked)
+		return
+	}
+
 	// Find user
 	var user models.User
 	if err := h.db.Where("username = ?", req.Username).First(&user).Error; err != nil {
+		// Spend the same bcrypt time as a wrong password so usernames cannot be probed
+		auth.CheckPasswordDummy(req.Password)
+		recordFailedLogin(h.db, h.cfg, c, req.Username, 0)
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"code":    401,
 			"message": "invalid credentials",
@@ -149,6 +185,7 @@ func (h *UserHandler) Login(c *gin.Context) {
 
 	// Check password
 	if !auth.CheckPassword(req.Password, user.PasswordHash) {
+		recordFailedLogin(h.db, h.cfg, c, req.Username, user.ID)
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"code":    401,
 			"message": "invalid credentials",
@@ -156,13 +193,171 @@ func (h *UserHandler) Login(c *gin.Context) {
 		return
 	}
 
+	// Users with 2FA enabled get a pending token to complete the second step
+	if user.MFAEnabled() {
+		mfaToken, err := auth.GenerateMFAToken(user.ID, h.keys, h.cfg.MFATokenExpiration)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"code":    500,
+				"message": "failed to generate token",
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"code":    200,
+			"message": "success",
+			"data": gin.H{
+				"mfa_required": true,
+				"mfa_token":    mfaToken,
+				"mfa_methods":  mfaMethods(&user),
+				"expires_in":   int(h.cfg.MFATokenExpiration.Seconds()),
+			},
+		})
+		return
+	}
+
+	h.completeLogin(c, &user)
+}
+
+// completeLogin records the login and responds with a new session's tokens
+func (h *UserHandler) completeLogin(c *gin.Context, user *models.User) {
+	var data gin.H
+	err := h.beginSession(c, user, func(tx *gorm.DB) error {
+		var err error
+		data, err = issueTokens(tx, h.cfg, h.keys, c, user)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to generate token",
+		})
+		return
+	}
+
+	// Roles covered by the 2FA policy must enroll before using other endpoints
+	if !user.MFAEnabled() && middleware.MFARequired(h.cfg, user.Status) {
+		data["mfa_enrollment_required"] = true
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    data,
+	})
+}
+
+// beginSession records a successful login and runs start, which creates the session,
+// in a transaction with the warning about sign-ins from a new address
+func (h *UserHandler) beginSession(c *gin.Context, user *models.User, start func(tx *gorm.DB) error) error {
+	resetLoginFailures(h.db, usernameThrottleKey(user.Username))
+
 	// Update last login
 	now := time.Now()
 	user.LastLogin = &now
-	h.db.Save(&user)
+	h.db.Save(user)
+
+	// Warn the user about sign-ins from an address they have not used before
+	var priorSessions, knownIPSessions int64
+	h.db.Model(&models.Session{}).Where("user_id = ?", user.ID).Count(&priorSessions)
+	h.db.Model(&models.Session{}).Where("user_id = ? AND ip_address = ?", user.ID, c.ClientIP()).Count(&knownIPSessions)
+	newIP := priorSessions > 0 && knownIPSessions == 0
+
+	return h.db.Transaction(func(tx *gorm.DB) error {
+		if err := start(tx); err != nil {
+			return err
+		}
+		if !newIP {
+			return nil
+		}
+		return notify.Enqueue(tx, user.ID, "new_ip_login", "", notify.Message{
+			Title: "TouNetCore sign-in from a new address",
+			Body: fmt.Sprintf("Your account %s signed in from %s (%s) at %s. If this was not you, change your password.",
+				user.Username, c.ClientIP(), c.GetHeader("User-Agent"), time.Now().Format(time.RFC1123)),
+		})
+	})
+}
+
+// RefreshToken exchanges a refresh token for a new access and refresh token pair
+func (h *UserHandler) RefreshToken(c *gin.Context) {
+	var req RefreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
+		})
+		return
+	}
+
+	var session models.Session
+	if err := h.db.Where("refresh_token_hash = ?", auth.HashToken(req.RefreshToken)).First(&session).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    401,
+			"message": "invalid refresh token",
+		})
+		return
+	}
+
+	if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    401,
+			"message": "invalid or expired refresh token",
+		})
+		return
+	}
+
+	// Refresh tokens issued to OIDC clients are only accepted at the OIDC token endpoint
+	if session.ClientID != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    401,
+			"message": "invalid refresh token",
+		})
+		return
+	}
+
+	var user models.User
+	if err := h.db.First(&user, session.UserID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    401,
+			"message": "user not found",
+		})
+		return
+	}
+
+	// Rotate: mark the presented token as used and issue a successor in the same family.
+	// A token that was already rotated is being replayed, so the whole family is revoked.
+	refreshToken, reused, err := rotateSession(h.db, h.cfg, c, &session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to refresh token",
+		})
+		return
+	}
+
+	if reused {
+		revokeSessionFamily(h.db, session.FamilyID)
+
+		auditLog := models.AuditLog{
+			ActionType: "REFRESH_TOKEN_REUSE",
+			TargetType: "SESSION",
+			TargetID:   session.FamilyID,
+			OperatorID: models.AuditOperator(user.ID),
+			IPAddress:  c.ClientIP(),
+			UserAgent:  c.GetHeader("User-Agent"),
+			Details:    fmt.Sprintf("Refresh token reused for user %s, session family revoked", user.Username),
+		}
+		h.db.Create(&auditLog)
+
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    401,
+			"message": "refresh token reuse detected, session revoked",
+		})
+		return
+	}
 
-	// Generate JWT token
-	token, err := auth.GenerateJWT(&user, h.cfg.JWTSecret, h.cfg.JWTExpiration)
+	data, err := tokenResponse(h.cfg, h.keys, &user, session.FamilyID, refreshToken)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    500,
@@ -174,9 +369,36 @@ func (h *UserHandler) Login(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
 		"message": "success",
-		"data": gin.H{
-			"token": token,
-		},
+		"data":    data,
+	})
+}
+
+// Logout revokes the current access token and its session
+func (h *UserHandler) Logout(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	sessionID, _ := c.Get("session_id")
+	tokenID, _ := c.Get("token_id")
+	expiresAt, _ := c.Get("token_expires_at")
+
+	if err := revokeAccessToken(h.db, tokenID.(string), userID.(uint), expiresAt.(time.Time)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to revoke token",
+		})
+		return
+	}
+
+	if err := revokeSessionFamily(h.db, sessionID.(string)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to revoke session",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
 	})
 }
 
@@ -197,12 +419,15 @@ func (h *UserHandler) GetUserInfo(c *gin.Context) {
 		"code":    200,
 		"message": "success",
 		"data": gin.H{
-			"id":         user.ID,
-			"username":   user.Username,
-			"status":     user.Status,
-			"phone":      user.Phone,
-			"created_at": user.CreatedAt,
-			"last_login": user.LastLogin,
+			"id":             user.ID,
+			"username":       user.Username,
+			"status":         user.Status,
+			"phone":          user.Phone,
+			"email":          user.Email,
+			"webhook_url":    user.WebhookURL,
+			"notify_channel": user.NotifyChannel,
+			"created_at":     user.CreatedAt,
+			"last_login":     user.LastLogin,
 		},
 	})
 }
@@ -236,6 +461,41 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 	if req.PushDeerToken != "" {
 		user.PushDeerToken = req.PushDeerToken
 	}
+	if req.Email != "" {
+		if _, err := mail.ParseAddress(req.Email); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "invalid email address",
+			})
+			return
+		}
+		user.Email = req.Email
+	}
+	if req.WebhookURL != "" {
+		// Webhooks are posted from inside the network, so they may not target internal hosts
+		if err := notify.CheckPublicURL(c.Request.Context(), req.WebhookURL); err != nil {
+			message := "invalid webhook url"
+			if errors.Is(err, notify.ErrPrivateAddress) {
+				message = "webhook url must resolve to a public address"
+			}
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": message,
+			})
+			return
+		}
+		user.WebhookURL = req.WebhookURL
+	}
+	if req.NotifyChannel != "" {
+		if !notify.IsChannel(h.cfg.Environment, req.NotifyChannel) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "invalid notify_channel, must be one of: " + strings.Join(notify.Channels(h.cfg.Environment), ", "),
+			})
+			return
+		}
+		user.NotifyChannel = req.NotifyChannel
+	}
 
 	if err := h.db.Save(&user).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -244,6 +504,89 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 		})
 		return
 	}
+	middleware.InvalidateUser(user.ID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
+
+// ChangePassword changes the current user's password and signs out their other sessions
+func (h *UserHandler) ChangePassword(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	sessionID, _ := c.Get("session_id")
+
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
+		})
+		return
+	}
+
+	var user models.User
+	if err := h.db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "user not found",
+		})
+		return
+	}
+
+	// The current password is a login credential, so guessing it is throttled like login
+	if wait, locked := checkLoginThrottle(h.db, h.cfg, usernameThrottleKey(user.Username), ipThrottleKey(c.ClientIP())); wait > 0 {
+		respondThrottled(c, wait, locked)
+		return
+	}
+
+	if !auth.CheckPassword(req.CurrentPassword, user.PasswordHash) {
+		recordFailedLogin(h.db, h.cfg, c, user.Username, user.ID)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    401,
+			"message": "current password is incorrect",
+		})
+		return
+	}
+
+	if err := validateNewPassword(h.db, h.cfg, &user, req.NewPassword); err != nil {
+		respondPasswordError(c, err)
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to hash password",
+		})
+		return
+	}
+
+	if err := h.db.Model(&user).Update("password_hash", hashedPassword).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to update password",
+		})
+		return
+	}
+	recordPasswordHistory(h.db, h.cfg, user.ID, hashedPassword)
+	resetLoginFailures(h.db, usernameThrottleKey(user.Username))
+
+	// Keep the session that made the change, sign out everywhere else
+	revokeOtherSessions(h.db, user.ID, sessionID.(string))
+
+	auditLog := models.AuditLog{
+		ActionType: "CHANGE_PASSWORD",
+		TargetType: "USER",
+		TargetID:   fmt.Sprintf("%d", user.ID),
+		OperatorID: models.AuditOperator(user.ID),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("User %s changed their password", user.Username),
+	}
+	h.db.Create(&auditLog)
 
 	c.JSON(http.StatusOK, gin.H{
 		"code":    200,
@@ -256,23 +599,9 @@ func (h *UserHandler) ListAllowedApps(c *gin.Context) {
 	userID, _ := c.Get("user_id")
 	userStatus, _ := c.Get("user_status")
 
-	// Get all apps that match user's permission level
+	// Get all active apps; the access mode of each decides whether it is listed
 	var apps []models.App
-	query := h.db.Where("is_active = ?", true)
-
-	// Filter based on user status
-	switch userStatus {
-	case models.StatusAdmin:
-		// Admin can see all apps
-	case models.StatusTrusted:
-		query = query.Where("required_permission_level IN (?)", []models.UserStatus{models.StatusDisabledUser, models.StatusUser, models.StatusTrusted})
-	case models.StatusUser:
-		query = query.Where("required_permission_level IN (?)", []models.UserStatus{models.StatusDisabledUser, models.StatusUser})
-	case models.StatusDisabledUser:
-		query = query.Where("required_permission_level = ?", models.StatusDisabledUser)
-	}
-
-	if err := query.Find(&apps).Error; err != nil {
+	if err := h.db.Where("is_active = ?", true).Find(&apps).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code":    500,
 			"message": "failed to fetch apps",
@@ -293,6 +622,11 @@ func (h *UserHandler) ListAllowedApps(c *gin.Context) {
 	// Build response
 	var result []gin.H
 	for _, app := range apps {
+		userApp, hasGrant := userAppMap[app.AppID]
+		if !appOpenTo(&app, userStatus.(models.UserStatus), hasGrant) {
+			continue
+		}
+
 		appData := gin.H{
 			"app_id":      app.AppID,
 			"name":        app.Name,
@@ -302,7 +636,7 @@ func (h *UserHandler) ListAllowedApps(c *gin.Context) {
 		}
 
 		// Check user-specific permissions
-		if userApp, exists := userAppMap[app.AppID]; exists {
+		if hasGrant {
 			appData["enabled"] = userApp.Enabled
 			appData["valid_until"] = userApp.ValidUntil
 		}
@@ -0,0 +1,565 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"tounetcore/internal/auth"
+	"tounetcore/internal/config"
+	"tounetcore/internal/middleware"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"gorm.io/gorm"
+)
+
+// webAuthnCeremonyTimeout bounds how long a begun ceremony can be finished
+const webAuthnCeremonyTimeout = 5 * time.Minute
+
+type WebAuthnHandler struct {
+	db       *gorm.DB
+	cfg      *config.Config
+	webAuthn *webauthn.WebAuthn
+	users    *UserHandler
+}
+
+func NewWebAuthnHandler(db *gorm.DB, cfg *config.Config, keys *auth.KeySet) *WebAuthnHandler {
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          cfg.WebAuthnRPID,
+		RPDisplayName: cfg.WebAuthnRPName,
+		RPOrigins:     cfg.WebAuthnOrigins,
+	})
+	if err != nil {
+		log.Printf("WebAuthn disabled: %v", err)
+	}
+	return &WebAuthnHandler{db: db, cfg: cfg, webAuthn: w, users: NewUserHandler(db, cfg, keys)}
+}
+
+// WebAuthnLoginBeginRequest represents the start of a passkey login.
+// Without a username or mfa_token a discoverable (usernameless) login is started.
+type WebAuthnLoginBeginRequest struct {
+	Username string `json:"username"`
+	MFAToken string `json:"mfa_token"`
+}
+
+// webAuthnUser adapts a user and their credentials to the webauthn.User interface
+type webAuthnUser struct {
+	user        *models.User
+	credentials []webauthn.Credential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return webAuthnUserHandle(u.user.ID)
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	return u.user.Username
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+// webAuthnUserHandle encodes a user ID as the opaque WebAuthn user handle
+func webAuthnUserHandle(userID uint) []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(userID))
+	return handle
+}
+
+// BeginRegistration starts registering a new passkey for the current user
+func (h *WebAuthnHandler) BeginRegistration(c *gin.Context) {
+	if !h.enabled(c) {
+		return
+	}
+	userID, _ := c.Get("user_id")
+
+	waUser, err := h.loadWebAuthnUser(userID.(uint))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "user not found",
+		})
+		return
+	}
+
+	options, session, err := h.webAuthn.BeginRegistration(waUser,
+		webauthn.WithExclusions(webauthn.Credentials(waUser.credentials).CredentialDescriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to begin registration",
+		})
+		return
+	}
+
+	ceremonyID, err := h.saveCeremony(&waUser.user.ID, "register", session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to store ceremony",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"ceremony_id": ceremonyID,
+			"options":     options,
+		},
+	})
+}
+
+// FinishRegistration verifies the authenticator's attestation and stores the credential.
+// The request body is the PublicKeyCredential returned by navigator.credentials.create().
+func (h *WebAuthnHandler) FinishRegistration(c *gin.Context) {
+	if !h.enabled(c) {
+		return
+	}
+	userID, _ := c.Get("user_id")
+
+	session, ceremonyUserID, err := h.takeCeremony(c.Query("ceremony_id"), "register")
+	if err != nil || ceremonyUserID == nil || *ceremonyUserID != userID.(uint) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid or expired ceremony",
+		})
+		return
+	}
+
+	waUser, err := h.loadWebAuthnUser(userID.(uint))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "user not found",
+		})
+		return
+	}
+
+	credential, err := h.webAuthn.FinishRegistration(waUser, *session, c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "registration verification failed",
+		})
+		return
+	}
+
+	transports := make([]string, 0, len(credential.Transport))
+	for _, t := range credential.Transport {
+		transports = append(transports, string(t))
+	}
+
+	name := c.Query("name")
+	if name == "" {
+		name = "Passkey"
+	}
+
+	record := models.WebAuthnCredential{
+		UserID:          waUser.user.ID,
+		Name:            name,
+		CredentialID:    base64.RawURLEncoding.EncodeToString(credential.ID),
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      strings.Join(transports, ","),
+		AAGUID:          credential.Authenticator.AAGUID,
+		Flags:           uint8(credential.Flags.ProtocolValue()),
+		SignCount:       credential.Authenticator.SignCount,
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&record).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.User{}).Where("id = ?", waUser.user.ID).Update("has_passkeys", true).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to store credential",
+		})
+		return
+	}
+	middleware.InvalidateUser(waUser.user.ID)
+
+	auditLog := models.AuditLog{
+		ActionType: "REGISTER_PASSKEY",
+		TargetType: "USER",
+		TargetID:   fmt.Sprintf("%d", waUser.user.ID),
+		OperatorID: models.AuditOperator(waUser.user.ID),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("User %s registered passkey %q", waUser.user.Username, record.Name),
+	}
+	h.db.Create(&auditLog)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    record,
+	})
+}
+
+// ListCredentials returns the current user's registered passkeys
+func (h *WebAuthnHandler) ListCredentials(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	var credentials []models.WebAuthnCredential
+	if err := h.db.Where("user_id = ?", userID).Order("created_at").Find(&credentials).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to fetch credentials",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    credentials,
+	})
+}
+
+// DeleteCredential removes one of the current user's passkeys
+func (h *WebAuthnHandler) DeleteCredential(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	userStatus, _ := c.Get("user_status")
+
+	var user models.User
+	if err := h.db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "user not found",
+		})
+		return
+	}
+
+	var credential models.WebAuthnCredential
+	if err := h.db.Where("id = ? AND user_id = ?", c.Param("id"), user.ID).First(&credential).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "credential not found",
+		})
+		return
+	}
+
+	var remaining int64
+	h.db.Model(&models.WebAuthnCredential{}).Where("user_id = ? AND id != ?", user.ID, credential.ID).Count(&remaining)
+
+	// Do not let the last second factor go while the 2FA policy applies
+	if remaining == 0 && !user.TOTPEnabled && middleware.MFARequired(h.cfg, userStatus.(models.UserStatus)) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code":    403,
+			"message": "two-factor authentication is required for your role",
+		})
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&credential).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.User{}).Where("id = ?", user.ID).Update("has_passkeys", remaining > 0).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to delete credential",
+		})
+		return
+	}
+	middleware.InvalidateUser(user.ID)
+
+	auditLog := models.AuditLog{
+		ActionType: "DELETE_PASSKEY",
+		TargetType: "USER",
+		TargetID:   fmt.Sprintf("%d", user.ID),
+		OperatorID: models.AuditOperator(user.ID),
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("User %s deleted passkey %q", user.Username, credential.Name),
+	}
+	h.db.Create(&auditLog)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
+
+// BeginLogin starts a passkey assertion. With an mfa_token it completes a two-step
+// login, with a username it is a passwordless login for that account, and with
+// neither it is a discoverable login where the authenticator picks the account.
+func (h *WebAuthnHandler) BeginLogin(c *gin.Context) {
+	if !h.enabled(c) {
+		return
+	}
+
+	var req WebAuthnLoginBeginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid request data",
+		})
+		return
+	}
+
+	var (
+		options *protocol.CredentialAssertion
+		session *webauthn.SessionData
+		userID  *uint
+		purpose = "login"
+		err     error
+	)
+
+	switch {
+	case req.MFAToken != "":
+		id, tokenErr := auth.ValidateMFAToken(req.MFAToken, h.users.keys)
+		if tokenErr != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"code":    401,
+				"message": "invalid or expired mfa token",
+			})
+			return
+		}
+		userID = &id
+		purpose = "mfa"
+	case req.Username != "":
+		// Unknown usernames and accounts without passkeys get a discoverable login
+		// like anyone else, so the response does not reveal which accounts exist
+		var user models.User
+		if err := h.db.Where("username = ?", req.Username).First(&user).Error; err == nil {
+			if waUser, loadErr := h.loadWebAuthnUser(user.ID); loadErr == nil && len(waUser.credentials) > 0 {
+				userID = &user.ID
+			}
+		}
+	}
+
+	if userID != nil {
+		waUser, loadErr := h.loadWebAuthnUser(*userID)
+		if loadErr != nil || len(waUser.credentials) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "no passkeys registered",
+			})
+			return
+		}
+		options, session, err = h.webAuthn.BeginLogin(waUser)
+	} else {
+		options, session, err = h.webAuthn.BeginDiscoverableLogin()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to begin login",
+		})
+		return
+	}
+
+	ceremonyID, err := h.saveCeremony(userID, purpose, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": "failed to store ceremony",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"ceremony_id": ceremonyID,
+			"options":     options,
+		},
+	})
+}
+
+// FinishLogin verifies a passkey assertion and starts a session.
+// The request body is the PublicKeyCredential returned by navigator.credentials.get().
+func (h *WebAuthnHandler) FinishLogin(c *gin.Context) {
+	if !h.enabled(c) {
+		return
+	}
+
+	ceremonyID := c.Query("ceremony_id")
+	session, ceremonyUserID, err := h.takeCeremony(ceremonyID, "login", "mfa")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "invalid or expired ceremony",
+		})
+		return
+	}
+
+	var (
+		waUser     *webAuthnUser
+		credential *webauthn.Credential
+	)
+	if ceremonyUserID != nil {
+		waUser, err = h.loadWebAuthnUser(*ceremonyUserID)
+		if err == nil {
+			credential, err = h.webAuthn.FinishLogin(waUser, *session, c.Request)
+		}
+	} else {
+		credential, err = h.webAuthn.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			if len(userHandle) != 8 {
+				return nil, errors.New("invalid user handle")
+			}
+			waUser, err = h.loadWebAuthnUser(uint(binary.BigEndian.Uint64(userHandle)))
+			return waUser, err
+		}, *session, c.Request)
+	}
+	if err != nil || waUser == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    401,
+			"message": "passkey verification failed",
+		})
+		return
+	}
+
+	credentialID := base64.RawURLEncoding.EncodeToString(credential.ID)
+	if credential.Authenticator.CloneWarning {
+		auditLog := models.AuditLog{
+			ActionType: "PASSKEY_CLONE_WARNING",
+			TargetType: "USER",
+			TargetID:   fmt.Sprintf("%d", waUser.user.ID),
+			OperatorID: models.AuditOperator(waUser.user.ID),
+			IPAddress:  c.ClientIP(),
+			UserAgent:  c.GetHeader("User-Agent"),
+			Details:    fmt.Sprintf("Signature counter did not increase for passkey %s of user %s", credentialID, waUser.user.Username),
+		}
+		h.db.Create(&auditLog)
+
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    401,
+			"message": "passkey verification failed",
+		})
+		return
+	}
+
+	now := time.Now()
+	h.db.Model(&models.WebAuthnCredential{}).Where("credential_id = ?", credentialID).Updates(map[string]interface{}{
+		"sign_count":   credential.Authenticator.SignCount,
+		"last_used_at": now,
+	})
+
+	h.users.completeLogin(c, waUser.user)
+}
+
+// enabled responds with 503 when the relying party configuration is invalid
+func (h *WebAuthnHandler) enabled(c *gin.Context) bool {
+	if h.webAuthn == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"code":    503,
+			"message": "webauthn is not configured",
+		})
+		return false
+	}
+	return true
+}
+
+// loadWebAuthnUser loads a user together with their registered credentials
+func (h *WebAuthnHandler) loadWebAuthnUser(userID uint) (*webAuthnUser, error) {
+	var user models.User
+	if err := h.db.First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+
+	var records []models.WebAuthnCredential
+	if err := h.db.Where("user_id = ?", userID).Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	credentials := make([]webauthn.Credential, 0, len(records))
+	for _, record := range records {
+		id, err := base64.RawURLEncoding.DecodeString(record.CredentialID)
+		if err != nil {
+			continue
+		}
+		var transports []protocol.AuthenticatorTransport
+		for _, t := range strings.Split(record.Transports, ",") {
+			if t != "" {
+				transports = append(transports, protocol.AuthenticatorTransport(t))
+			}
+		}
+		credentials = append(credentials, webauthn.Credential{
+			ID:              id,
+			PublicKey:       record.PublicKey,
+			AttestationType: record.AttestationType,
+			Transport:       transports,
+			Flags:           webauthn.NewCredentialFlags(protocol.AuthenticatorFlags(record.Flags)),
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    record.AAGUID,
+				SignCount: record.SignCount,
+			},
+		})
+	}
+
+	return &webAuthnUser{user: &user, credentials: credentials}, nil
+}
+
+// saveCeremony stores session data for a begun ceremony and returns its ID
+func (h *WebAuthnHandler) saveCeremony(userID *uint, purpose string, session *webauthn.SessionData) (string, error) {
+	// Abandoned ceremonies are cleaned up as new ones start
+	h.db.Where("expires_at < ?", time.Now()).Delete(&models.WebAuthnCeremony{})
+
+	id, err := auth.GenerateTokenID()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	ceremony := models.WebAuthnCeremony{
+		ID:          id,
+		UserID:      userID,
+		Purpose:     purpose,
+		SessionData: string(data),
+		ExpiresAt:   time.Now().Add(webAuthnCeremonyTimeout),
+	}
+	if err := h.db.Create(&ceremony).Error; err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// takeCeremony loads and deletes a pending ceremony so it can only be finished once
+func (h *WebAuthnHandler) takeCeremony(id string, purposes ...string) (*webauthn.SessionData, *uint, error) {
+	var ceremony models.WebAuthnCeremony
+	if err := h.db.Where("id = ? AND purpose IN ?", id, purposes).First(&ceremony).Error; err != nil {
+		return nil, nil, err
+	}
+
+	result := h.db.Where("id = ?", ceremony.ID).Delete(&models.WebAuthnCeremony{})
+	if result.Error != nil || result.RowsAffected != 1 {
+		return nil, nil, errors.New("ceremony already used")
+	}
+	if time.Now().After(ceremony.ExpiresAt) {
+		return nil, nil, errors.New("ceremony expired")
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(ceremony.SessionData), &session); err != nil {
+		return nil, nil, err
+	}
+	return &session, ceremony.UserID, nil
+}
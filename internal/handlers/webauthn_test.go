@@ -0,0 +1,327 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"gorm.io/gorm"
+)
+
+const (
+	testRPID   = "localhost"
+	testOrigin = "http://localhost:3000"
+)
+
+// virtualAuthenticator is a software ES256 authenticator with a single credential
+type virtualAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newVirtualAuthenticator(t *testing.T) *virtualAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &virtualAuthenticator{key: key, credentialID: credentialID}
+}
+
+// create answers navigator.credentials.create() with a "none" attestation
+func (a *virtualAuthenticator) create(t *testing.T, options map[string]interface{}) []byte {
+	t.Helper()
+
+	publicKey := options["publicKey"].(map[string]interface{})
+	user := publicKey["user"].(map[string]interface{})
+	a.userHandle, _ = base64.RawURLEncoding.DecodeString(user["id"].(string))
+
+	coseKey, err := webauthncbor.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatalf("marshal cose key: %v", err)
+	}
+
+	// Attested credential data: AAGUID, credential ID length, credential ID, public key
+	attested := make([]byte, 16, 18+len(a.credentialID)+len(coseKey))
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, coseKey...)
+
+	authData := a.authenticatorData(0x41, attested) // user present, attested credential data
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatalf("marshal attestation: %v", err)
+	}
+
+	return a.credential(map[string]interface{}{
+		"clientDataJSON":    a.clientData("webauthn.create", publicKey["challenge"].(string)),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+	})
+}
+
+// get answers navigator.credentials.get() with a signed assertion
+func (a *virtualAuthenticator) get(t *testing.T, options map[string]interface{}) []byte {
+	t.Helper()
+
+	publicKey := options["publicKey"].(map[string]interface{})
+	clientData := a.clientData("webauthn.get", publicKey["challenge"].(string))
+	rawClientData, _ := base64.RawURLEncoding.DecodeString(clientData)
+
+	a.signCount++
+	authData := a.authenticatorData(0x01, nil) // user present
+	digest := sha256.Sum256(append(append([]byte{}, authData...), sha256Sum(rawClientData)...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("sign assertion: %v", err)
+	}
+
+	return a.credential(map[string]interface{}{
+		"clientDataJSON":    clientData,
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+		"signature":         base64.RawURLEncoding.EncodeToString(signature),
+		"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+	})
+}
+
+func (a *virtualAuthenticator) authenticatorData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+func (a *virtualAuthenticator) clientData(ceremony, challenge string) string {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    testOrigin,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (a *virtualAuthenticator) credential(response map[string]interface{}) []byte {
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":       id,
+		"rawId":    id,
+		"type":     "public-key",
+		"response": response,
+	})
+	return body
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// webAuthnTestServer routes the passkey ceremonies, with registration done as user
+func webAuthnTestServer(t *testing.T, db *gorm.DB, user *models.User) *gin.Engine {
+	t.Helper()
+
+	cfg := newTestConfig(t)
+	cfg.WebAuthnRPID = testRPID
+	cfg.WebAuthnOrigins = []string{testOrigin}
+	cfg.MFARequiredAdmin = false
+	cfg.MFARequiredTrusted = false
+	h := NewWebAuthnHandler(db, cfg, newTestKeys(t, cfg))
+
+	r := gin.New()
+	r.POST("/register/begin", asUser(user), h.BeginRegistration)
+	r.POST("/register/finish", asUser(user), h.FinishRegistration)
+	r.POST("/login/begin", h.BeginLogin)
+	r.POST("/login/finish", h.FinishLogin)
+	return r
+}
+
+// doJSON sends a request and decodes the {code,message,data} response
+func doJSON(t *testing.T, r http.Handler, method, path string, body []byte) (int, map[string]interface{}) {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var out map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &out)
+	return w.Code, out
+}
+
+// beginCeremony starts a ceremony and returns its ID and the options for the authenticator
+func beginCeremony(t *testing.T, r http.Handler, path string, body []byte) (string, map[string]interface{}) {
+	t.Helper()
+
+	status, out := doJSON(t, r, http.MethodPost, path, body)
+	if status != http.StatusOK {
+		t.Fatalf("%s: status %d: %v", path, status, out)
+	}
+	data := out["data"].(map[string]interface{})
+	return data["ceremony_id"].(string), data["options"].(map[string]interface{})
+}
+
+func registerPasskey(t *testing.T, r http.Handler, authenticator *virtualAuthenticator) {
+	t.Helper()
+
+	ceremonyID, options := beginCeremony(t, r, "/register/begin", nil)
+	status, out := doJSON(t, r, http.MethodPost, "/register/finish?ceremony_id="+ceremonyID+"&name=Test", authenticator.create(t, options))
+	if status != http.StatusOK {
+		t.Fatalf("finish registration: status %d: %v", status, out)
+	}
+}
+
+func TestWebAuthnRegistrationAndLogin(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "alice", models.StatusUser)
+	r := webAuthnTestServer(t, db, user)
+	authenticator := newVirtualAuthenticator(t)
+
+	registerPasskey(t, r, authenticator)
+
+	var stored models.User
+	db.First(&stored, user.ID)
+	if !stored.HasPasskeys {
+		t.Fatal("user not marked as having passkeys")
+	}
+
+	for _, tc := range []struct {
+		name string
+		body string
+	}{
+		{"username", `{"username":"alice"}`},
+		{"discoverable", `{}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ceremonyID, options := beginCeremony(t, r, "/login/begin", []byte(tc.body))
+			status, out := doJSON(t, r, http.MethodPost, "/login/finish?ceremony_id="+ceremonyID, authenticator.get(t, options))
+			if status != http.StatusOK {
+				t.Fatalf("finish login: status %d: %v", status, out)
+			}
+			if token, _ := out["data"].(map[string]interface{})["token"].(string); token == "" {
+				t.Fatalf("no token in %v", out)
+			}
+		})
+	}
+
+	var credential models.WebAuthnCredential
+	db.Where("user_id = ?", user.ID).First(&credential)
+	if credential.SignCount != authenticator.signCount || credential.LastUsedAt == nil {
+		t.Fatalf("credential use not recorded: sign_count=%d last_used_at=%v", credential.SignCount, credential.LastUsedAt)
+	}
+}
+
+func TestWebAuthnRegistrationRejectsBadAttestation(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "alice", models.StatusUser)
+	r := webAuthnTestServer(t, db, user)
+	authenticator := newVirtualAuthenticator(t)
+
+	ceremonyID, options := beginCeremony(t, r, "/register/begin", nil)
+	options["publicKey"].(map[string]interface{})["challenge"] = base64.RawURLEncoding.EncodeToString([]byte("not the challenge"))
+	status, out := doJSON(t, r, http.MethodPost, "/register/finish?ceremony_id="+ceremonyID, authenticator.create(t, options))
+	if status != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400: %v", status, out)
+	}
+	if _, leaked := out["error"]; leaked {
+		t.Fatalf("response exposes verification internals: %v", out)
+	}
+
+	var count int64
+	db.Model(&models.WebAuthnCredential{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("%d credentials stored after failed registration", count)
+	}
+}
+
+func TestWebAuthnLoginRejectsBadAssertions(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "alice", models.StatusUser)
+	r := webAuthnTestServer(t, db, user)
+	authenticator := newVirtualAuthenticator(t)
+	registerPasskey(t, r, authenticator)
+
+	t.Run("signature by another key", func(t *testing.T) {
+		impostor := newVirtualAuthenticator(t)
+		impostor.credentialID = authenticator.credentialID
+		impostor.userHandle = authenticator.userHandle
+
+		ceremonyID, options := beginCeremony(t, r, "/login/begin", []byte(`{"username":"alice"}`))
+		status, out := doJSON(t, r, http.MethodPost, "/login/finish?ceremony_id="+ceremonyID, impostor.get(t, options))
+		if status != http.StatusUnauthorized {
+			t.Fatalf("status %d, want 401: %v", status, out)
+		}
+	})
+
+	t.Run("ceremony replay", func(t *testing.T) {
+		ceremonyID, options := beginCeremony(t, r, "/login/begin", []byte(`{"username":"alice"}`))
+		assertion := authenticator.get(t, options)
+		if status, out := doJSON(t, r, http.MethodPost, "/login/finish?ceremony_id="+ceremonyID, assertion); status != http.StatusOK {
+			t.Fatalf("first use: status %d: %v", status, out)
+		}
+		if status, out := doJSON(t, r, http.MethodPost, "/login/finish?ceremony_id="+ceremonyID, assertion); status != http.StatusBadRequest {
+			t.Fatalf("replay: status %d, want 400: %v", status, out)
+		}
+	})
+
+	t.Run("cloned authenticator", func(t *testing.T) {
+		// A counter that does not advance past the stored one indicates a cloned key
+		authenticator.signCount = 0
+		ceremonyID, options := beginCeremony(t, r, "/login/begin", []byte(`{"username":"alice"}`))
+		status, out := doJSON(t, r, http.MethodPost, "/login/finish?ceremony_id="+ceremonyID, authenticator.get(t, options))
+		if status != http.StatusUnauthorized {
+			t.Fatalf("status %d, want 401: %v", status, out)
+		}
+
+		var warnings int64
+		db.Model(&models.AuditLog{}).Where("action_type = ?", "PASSKEY_CLONE_WARNING").Count(&warnings)
+		if warnings != 1 {
+			t.Fatalf("%d clone warnings audited, want 1", warnings)
+		}
+	})
+}
+
+func TestWebAuthnBeginLoginDoesNotRevealAccounts(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "alice", models.StatusUser)
+	createTestUser(t, db, "bob", models.StatusUser)
+	r := webAuthnTestServer(t, db, user)
+	registerPasskey(t, r, newVirtualAuthenticator(t))
+
+	// An account without passkeys and an unknown one must look the same
+	for _, username := range []string{"bob", "nobody"} {
+		status, out := doJSON(t, r, http.MethodPost, "/login/begin", []byte(`{"username":"`+username+`"}`))
+		if status != http.StatusOK {
+			t.Fatalf("%s: status %d: %v", username, status, out)
+		}
+		options := out["data"].(map[string]interface{})["options"].(map[string]interface{})
+		if _, targeted := options["publicKey"].(map[string]interface{})["allowCredentials"]; targeted {
+			t.Fatalf("%s: options list credentials: %v", username, options)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"tounetcore/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// appSignatureMaxSkew is how far an HMAC request timestamp may be from server time
+	appSignatureMaxSkew = 5 * time.Minute
+	// appAuthMaxBody limits the request body read for HMAC verification
+	appAuthMaxBody = 1 << 20
+)
+
+// AppSignature computes the hex HMAC-SHA256 signature of a timestamped request as
+// "<timestamp>.<method>.<request URI>.<body>" keyed with the app secret. The request URI
+// is the path and query, so a signature cannot be replayed against another endpoint.
+func AppSignature(secret, timestamp, method, requestURI string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + method + "." + requestURI + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AppAuthMiddleware authenticates the calling application with either HTTP Basic
+// (app_id:secret_key) or the X-App-ID, X-App-Timestamp and X-App-Signature headers.
+// The authenticated app ID is stored in the context as "app_id".
+func AppAuthMiddleware(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		appID, secret, basic := c.Request.BasicAuth()
+		if !basic {
+			appID = c.GetHeader("X-App-ID")
+		}
+		if appID == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"code":    401,
+				"message": "app credentials required",
+			})
+			c.Abort()
+			return
+		}
+
+		var app models.App
+		if err := db.Where("app_id = ?", appID).First(&app).Error; err != nil {
+			appAuthFailed(db, c, appID, "unknown app")
+			return
+		}
+
+		if basic {
+			if subtle.ConstantTimeCompare([]byte(secret), []byte(app.SecretKey)) != 1 {
+				appAuthFailed(db, c, appID, "wrong secret key")
+				return
+			}
+		} else if reason := verifyAppSignature(c, app.SecretKey); reason != "" {
+			appAuthFailed(db, c, appID, reason)
+			return
+		}
+
+		if !app.IsActive {
+			LogAppAuthFailure(db, c, appID, "app is inactive")
+			c.JSON(http.StatusForbidden, gin.H{
+				"code":    403,
+				"message": "app is inactive",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Set("app_id", app.AppID)
+		c.Next()
+	}
+}
+
+// verifyAppSignature checks the HMAC headers and restores the request body for binding.
+// It returns an empty string on success or the reason for rejection.
+func verifyAppSignature(c *gin.Context, secret string) string {
+	timestamp := c.GetHeader("X-App-Timestamp")
+	signature := c.GetHeader("X-App-Signature")
+	if timestamp == "" || signature == "" {
+		return "missing signature headers"
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "invalid timestamp"
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > appSignatureMaxSkew || skew < -appSignatureMaxSkew {
+		return "timestamp outside allowed window"
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, appAuthMaxBody))
+	if err != nil {
+		return "unreadable body"
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := AppSignature(secret, timestamp, c.Request.Method, c.Request.URL.RequestURI(), body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "invalid signature"
+	}
+	return ""
+}
+
+// appAuthFailed audits a failed app authentication and aborts with 401
+func appAuthFailed(db *gorm.DB, c *gin.Context, appID, reason string) {
+	LogAppAuthFailure(db, c, appID, reason)
+	c.JSON(http.StatusUnauthorized, gin.H{
+		"code":    401,
+		"message": "invalid app credentials",
+	})
+	c.Abort()
+}
+
+// LogAppAuthFailure records a failed app authentication in the audit log
+func LogAppAuthFailure(db *gorm.DB, c *gin.Context, appID, reason string) {
+	auditLog := models.AuditLog{
+		ActionType: "APP_AUTH_FAILED",
+		TargetType: "APP",
+		TargetID:   appID,
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.GetHeader("User-Agent"),
+		Details:    fmt.Sprintf("App authentication failed for %s on %s: %s", appID, c.FullPath(), reason),
+	}
+	db.Create(&auditLog)
+}
@@ -4,13 +4,27 @@ import (
 	"net/http"
 	"strings"
 	"tounetcore/internal/auth"
+	"tounetcore/internal/config"
 	"tounetcore/internal/models"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
-// AuthMiddleware validates JWT tokens
-func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
+// NewEngine creates a gin engine with the default logger and recovery middleware. The
+// client address is only taken from X-Forwarded-For and X-Real-IP when the request comes
+// from one of the configured trusted proxies; otherwise it is the connection's address.
+func NewEngine(cfg *config.Config) (*gin.Engine, error) {
+	router := gin.Default()
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	return router, nil
+}
+
+// AuthMiddleware validates JWT tokens, rejects revoked sessions and loads the current user.
+// Deleted and disabled users are refused on every protected route.
+func AuthMiddleware(db *gorm.DB, keys *auth.KeySet) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -34,7 +48,7 @@ func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
 		}
 
 		token := tokenParts[1]
-		claims, err := auth.ValidateJWT(token, jwtSecret)
+		claims, err := auth.ValidateJWT(token, keys)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"code":    401,
@@ -44,14 +58,67 @@ func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
 			return
 		}
 
+		// Reject tokens without a session or whose session family was revoked
+		if claims.SessionID == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"code":    401,
+				"message": "invalid or expired token",
+			})
+			c.Abort()
+			return
+		}
+		if IsTokenRevoked(db, claims) {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"code":    401,
+				"message": "token has been revoked",
+			})
+			c.Abort()
+			return
+		}
+
+		// Resolve the live user so deletes and role changes apply immediately
+		user, err := loadUser(db, claims.UserID)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"code":    401,
+				"message": "user not found",
+			})
+			c.Abort()
+			return
+		}
+		if user.Status == models.StatusDisabledUser {
+			c.JSON(http.StatusForbidden, gin.H{
+				"code":    403,
+				"message": "account is disabled",
+			})
+			c.Abort()
+			return
+		}
+
 		// Store user information in context
-		c.Set("user_id", claims.UserID)
-		c.Set("username", claims.Username)
-		c.Set("user_status", claims.Status)
+		c.Set("user_id", user.ID)
+		c.Set("username", user.Username)
+		c.Set("user_status", user.Status)
+		c.Set("mfa_enabled", user.MFAEnabled())
+		c.Set("session_id", claims.SessionID)
+		c.Set("token_id", claims.ID)
+		c.Set("token_expires_at", claims.ExpiresAt.Time)
 		c.Next()
 	}
 }
 
+// IsTokenRevoked checks the revocation list and the token's session family
+func IsTokenRevoked(db *gorm.DB, claims *auth.Claims) bool {
+	var count int64
+	if err := db.Model(&models.RevokedToken{}).Where("jti = ?", claims.ID).Count(&count).Error; err != nil || count > 0 {
+		return true
+	}
+	if err := db.Model(&models.Session{}).Where("family_id = ? AND revoked_at IS NOT NULL", claims.SessionID).Count(&count).Error; err != nil || count > 0 {
+		return true
+	}
+	return false
+}
+
 // AdminMiddleware ensures only admin users can access the endpoint
 func AdminMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -132,6 +199,38 @@ func RequirePermissionMiddleware(requiredLevel models.UserStatus) gin.HandlerFun
 	}
 }
 
+// MFARequired reports whether the 2FA policy applies to the given user status
+func MFARequired(cfg *config.Config, status models.UserStatus) bool {
+	switch status {
+	case models.StatusAdmin:
+		return cfg.MFARequiredAdmin
+	case models.StatusTrusted:
+		return cfg.MFARequiredTrusted
+	default:
+		return false
+	}
+}
+
+// MFAEnrollmentMiddleware blocks users whose role requires 2FA until they have enrolled
+func MFAEnrollmentMiddleware(cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userStatus, _ := c.Get("user_status")
+		mfaEnabled, _ := c.Get("mfa_enabled")
+
+		status, _ := userStatus.(models.UserStatus)
+		if enabled, _ := mfaEnabled.(bool); !enabled && MFARequired(cfg, status) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"code":    403,
+				"message": "two-factor authentication enrollment required",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
 // CORSMiddleware handles cross-origin requests
 func CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
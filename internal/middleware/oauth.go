@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"tounetcore/internal/auth"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ClientTokenMiddleware validates access tokens issued to OIDC clients. Errors follow
+// RFC 6750 rather than the API response format, since OIDC clients expect them.
+func ClientTokenMiddleware(db *gorm.DB, keys *auth.KeySet, issuer string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := ""
+		if parts := strings.SplitN(c.GetHeader("Authorization"), " ", 2); len(parts) == 2 && strings.EqualFold(parts[0], "Bearer") {
+			token = parts[1]
+		}
+		if token == "" {
+			c.Header("WWW-Authenticate", `Bearer realm="tounetcore"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := auth.ValidateClientAccessToken(token, keys, issuer)
+		if err != nil || claims.SessionID == "" || IsTokenRevoked(db, claims) {
+			invalidClientToken(c, "invalid, expired or revoked access token")
+			return
+		}
+
+		user, err := loadUser(db, claims.UserID)
+		if err != nil {
+			invalidClientToken(c, "user not found")
+			return
+		}
+
+		c.Set("user_id", user.ID)
+		c.Set("username", user.Username)
+		c.Set("user_status", user.Status)
+		c.Set("session_id", claims.SessionID)
+		c.Set("client_id", claims.ClientID)
+		c.Set("scope", claims.Scope)
+		c.Next()
+	}
+}
+
+// invalidClientToken aborts with an RFC 6750 invalid_token error
+func invalidClientToken(c *gin.Context, description string) {
+	c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer realm="tounetcore", error="invalid_token", error_description=%q`, description))
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+		"error":             "invalid_token",
+		"error_description": description,
+	})
+}
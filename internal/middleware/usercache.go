@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+	"tounetcore/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// userCacheTTL bounds how long a role change can take to reach other server instances
+const userCacheTTL = 30 * time.Second
+
+type cachedUser struct {
+	user      models.User
+	expiresAt time.Time
+}
+
+var (
+	userCacheMu        sync.RWMutex
+	userCache          = make(map[uint]cachedUser)
+	userCacheLastSweep time.Time
+)
+
+// loadUser returns the current user record, served from a short-lived cache
+func loadUser(db *gorm.DB, userID uint) (*models.User, error) {
+	userCacheMu.RLock()
+	entry, ok := userCache[userID]
+	userCacheMu.RUnlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		user := entry.user
+		return &user, nil
+	}
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		InvalidateUser(userID)
+		return nil, err
+	}
+
+	now := time.Now()
+	userCacheMu.Lock()
+	userCache[userID] = cachedUser{user: user, expiresAt: now.Add(userCacheTTL)}
+	// Drop expired entries once per TTL so users who stopped calling do not stay cached
+	if now.Sub(userCacheLastSweep) > userCacheTTL {
+		for id, cached := range userCache {
+			if now.After(cached.expiresAt) {
+				delete(userCache, id)
+			}
+		}
+		userCacheLastSweep = now
+	}
+	userCacheMu.Unlock()
+
+	return &user, nil
+}
+
+// InvalidateUser drops a cached user so the next request reloads it from the database
+func InvalidateUser(userID uint) {
+	userCacheMu.Lock()
+	delete(userCache, userID)
+	userCacheMu.Unlock()
+}
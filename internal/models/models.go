@@ -13,17 +13,29 @@ type User struct {
 	PasswordHash  string         `gorm:"not null" json:"-"`
 	Phone         string         `json:"phone"`
 	PushDeerToken string         `json:"pushdeer_token"`
+	Email         string         `json:"email"`
+	WebhookURL    string         `json:"webhook_url"`
+	NotifyChannel string         `gorm:"type:varchar(20)" json:"notify_channel"` // pushdeer, email, sms, webhook, log or none; empty picks the first available
 	Status        UserStatus     `gorm:"type:varchar(20);default:user" json:"status"`
 	CreatedAt     time.Time      `json:"created_at"`
 	UpdatedAt     time.Time      `json:"updated_at"`
 	DeletedAt     gorm.DeletedAt `gorm:"index" json:"-"`
 	LastLogin     *time.Time     `json:"last_login"`
+	TOTPSecret    string         `json:"-"`
+	TOTPEnabled   bool           `gorm:"default:false" json:"totp_enabled"`
+	TOTPLastStep  int64          `json:"-"` // Last accepted TOTP time step, prevents code replay
+	HasPasskeys   bool           `gorm:"default:false" json:"has_passkeys"`
 
 	// Relationships
 	AllowedApps []UserAllowedApp `gorm:"foreignKey:UserID" json:"allowed_apps,omitempty"`
 	NKeys       []NKey           `gorm:"foreignKey:UserID" json:"nkeys,omitempty"`
 }
 
+// MFAEnabled reports whether the user has any second factor enrolled
+func (u *User) MFAEnabled() bool {
+	return u.TOTPEnabled || u.HasPasskeys
+}
+
 // UserStatus represents the status/role of a user
 type UserStatus string
 
@@ -56,6 +68,23 @@ func (us UserStatus) HasPermission(required UserStatus) bool {
 	return us.GetPermissionLevel() >= required.GetPermissionLevel()
 }
 
+// AccessMode decides how user grants combine with an app's required permission level
+type AccessMode string
+
+const (
+	// AccessRoleBased admits users with the required level unless a grant blocks them
+	AccessRoleBased AccessMode = "role_based"
+	// AccessAllowList only admits users with the required level and an active grant
+	AccessAllowList AccessMode = "allow_list"
+	// AccessDenyList admits every enabled user unless a grant blocks them
+	AccessDenyList AccessMode = "deny_list"
+)
+
+// Valid reports whether the access mode is known
+func (m AccessMode) Valid() bool {
+	return m == AccessRoleBased || m == AccessAllowList || m == AccessDenyList
+}
+
 // InviteCode represents an invitation code
 type InviteCode struct {
 	Code       string     `gorm:"primaryKey" json:"code"`
@@ -77,6 +106,10 @@ type NKey struct {
 	FirstUsedAt  *time.Time `json:"first_used_at"`
 	FirstUsedApp string     `json:"first_used_app"`
 	IsUsed       bool       `gorm:"default:false" json:"is_used"`
+	SingleUse    bool       `gorm:"default:false" json:"single_use"` // consumed by the first successful validation
+	Nonce        string     `gorm:"index" json:"nonce"`              // identifies signed NKeys in the revocation list
+	Service      string     `gorm:"type:text" json:"service"`        // service URL of a CAS ticket
+	RevokedAt    *time.Time `json:"revoked_at"`
 	CreatedAt    time.Time  `json:"created_at"`
 
 	// Relationships
@@ -91,7 +124,11 @@ type App struct {
 	Description             string     `json:"description"`
 	URL                     string     `json:"url"` // Application URL
 	RequiredPermissionLevel UserStatus `gorm:"type:varchar(20);default:user" json:"required_permission_level"`
+	AccessMode              AccessMode `gorm:"type:varchar(20);default:role_based" json:"access_mode"`
 	IsActive                bool       `gorm:"default:true" json:"is_active"`
+	SingleUseNKeys          bool       `gorm:"column:single_use_nkeys;default:false" json:"single_use_nkeys"` // every NKey is consumed by its first validation for this app
+	RedirectURIs            string     `gorm:"type:text" json:"redirect_uris"`                                // JSON array of OIDC redirect URIs
+	PostLogoutRedirectURIs  string     `gorm:"type:text" json:"post_logout_redirect_uris"`                    // JSON array of OIDC post-logout redirect URIs
 	CreatedAt               time.Time  `json:"created_at"`
 	UpdatedAt               time.Time  `json:"updated_at"`
 }
@@ -117,7 +154,7 @@ type AuditLog struct {
 	ActionType string    `gorm:"not null" json:"action_type"`
 	TargetType string    `gorm:"not null" json:"target_type"`
 	TargetID   string    `json:"target_id"`
-	OperatorID uint      `json:"operator_id"`
+	OperatorID *uint     `json:"operator_id"` // nil for anonymous events such as failed logins
 	IPAddress  string    `json:"ip_address"`
 	UserAgent  string    `json:"user_agent"`
 	Details    string    `gorm:"type:text" json:"details"` // JSON format
@@ -126,3 +163,170 @@ type AuditLog struct {
 	// Relationships
 	Operator *User `gorm:"foreignKey:OperatorID" json:"operator,omitempty"`
 }
+
+// AuditOperator returns a user ID for AuditLog.OperatorID, or nil when there is no user
+func AuditOperator(userID uint) *uint {
+	if userID == 0 {
+		return nil
+	}
+	return &userID
+}
+
+// Session represents a refresh token issued for a login.
+// Tokens rotated from the same login share a FamilyID.
+type Session struct {
+	ID               uint       `gorm:"primaryKey" json:"id"`
+	UserID           uint       `gorm:"not null;index" json:"user_id"`
+	FamilyID         string     `gorm:"not null;index" json:"family_id"`
+	ClientID         string     `gorm:"type:text;index" json:"client_id"` // OIDC client the session was issued to, empty for TouNetCore logins
+	Scope            string     `json:"scope"`                            // scopes granted to the OIDC client
+	RefreshTokenHash string     `gorm:"uniqueIndex;not null" json:"-"`
+	ExpiresAt        time.Time  `gorm:"not null" json:"expires_at"`
+	RotatedAt        *time.Time `json:"rotated_at"`
+	RevokedAt        *time.Time `json:"revoked_at"`
+	IPAddress        string     `json:"ip_address"`
+	UserAgent        string     `json:"user_agent"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+
+	// Relationships
+	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+// RevokedToken represents an access token revoked before its expiry
+type RevokedToken struct {
+	JTI       string    `gorm:"primaryKey;type:varchar(64)" json:"jti"`
+	UserID    uint      `gorm:"index" json:"user_id"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RecoveryCode represents a hashed single-use 2FA recovery code
+type RecoveryCode struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	CodeHash  string     `gorm:"not null;index" json:"-"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// WebAuthnCredential represents a registered passkey or security key
+type WebAuthnCredential struct {
+	ID              uint       `gorm:"primaryKey" json:"id"`
+	UserID          uint       `gorm:"not null;index" json:"user_id"`
+	Name            string     `json:"name"`
+	CredentialID    string     `gorm:"uniqueIndex;not null" json:"credential_id"` // base64url encoded
+	PublicKey       []byte     `gorm:"not null" json:"-"`
+	AttestationType string     `json:"attestation_type"`
+	Transports      string     `json:"transports"` // Comma separated
+	AAGUID          []byte     `json:"-"`
+	Flags           uint8      `json:"-"`
+	SignCount       uint32     `json:"sign_count"`
+	LastUsedAt      *time.Time `json:"last_used_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// WebAuthnCeremony stores the server-side state of a pending WebAuthn registration or login
+type WebAuthnCeremony struct {
+	ID          string    `gorm:"primaryKey;type:varchar(64)" json:"id"`
+	UserID      *uint     `json:"user_id"`
+	Purpose     string    `gorm:"type:varchar(20);not null" json:"purpose"` // register, login or mfa
+	SessionData string    `gorm:"type:text;not null" json:"-"`              // JSON encoded webauthn.SessionData
+	ExpiresAt   time.Time `gorm:"not null;index" json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// LoginThrottle tracks failed login attempts for a username or client IP
+type LoginThrottle struct {
+	Key           string     `gorm:"primaryKey;column:throttle_key;type:varchar(255)" json:"key"` // "user:<username>" or "ip:<address>"
+	Failures      int        `gorm:"not null;default:0" json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// UsageCounter counts NKeys issued and validated per user, app and time window
+// for the quotas in UserAllowedApp.CustomLimit
+type UsageCounter struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	UserID      uint      `gorm:"not null;uniqueIndex:idx_usage_counter" json:"user_id"`
+	AppID       string    `gorm:"not null;type:varchar(255);uniqueIndex:idx_usage_counter" json:"app_id"`
+	Kind        string    `gorm:"not null;type:varchar(20);uniqueIndex:idx_usage_counter" json:"kind"` // nkeys_hour, nkeys_day or validations_day
+	WindowStart time.Time `gorm:"not null;uniqueIndex:idx_usage_counter" json:"window_start"`
+	Count       int       `gorm:"not null;default:0" json:"count"`
+}
+
+// PasswordHistory stores previous password hashes to prevent reuse
+type PasswordHistory struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	UserID       uint      `gorm:"not null;index" json:"user_id"`
+	PasswordHash string    `gorm:"not null" json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// PasswordReset represents a one-time code issued to reset a forgotten password
+type PasswordReset struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	CodeHash  string     `gorm:"not null" json:"-"`
+	Channel   string     `gorm:"type:varchar(20)" json:"channel"` // notification channel the code was sent over
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	Attempts  int        `gorm:"default:0" json:"attempts"`
+	IPAddress string     `gorm:"index" json:"ip_address"`
+	CreatedAt time.Time  `gorm:"index" json:"created_at"`
+}
+
+// NotificationStatus represents the delivery state of an outbox notification
+type NotificationStatus string
+
+const (
+	NotificationPending NotificationStatus = "pending"
+	NotificationSent    NotificationStatus = "sent"
+	NotificationDead    NotificationStatus = "dead"    // gave up after the maximum number of attempts
+	NotificationSkipped NotificationStatus = "skipped" // user has no usable channel
+)
+
+// SecretNotificationEvents are the events whose body carries an NKey or reset code.
+// Their bodies are cleared as soon as delivery ends, successfully or not, and they
+// are never requeued.
+var SecretNotificationEvents = []string{"nkey_issued", "password_reset"}
+
+// Notification is an outbox entry delivered to a user by the notification worker
+type Notification struct {
+	ID            uint               `gorm:"primaryKey" json:"id"`
+	UserID        uint               `gorm:"not null;index" json:"user_id"`
+	Event         string             `gorm:"type:varchar(50);not null" json:"event"` // nkey_issued, new_ip_login, password_reset
+	Channel       string             `gorm:"type:varchar(20)" json:"channel"`        // requested channel, empty for the user's preference
+	Title         string             `json:"title"`
+	Body          string             `json:"-"` // may contain NKeys or reset codes, cleared once sent
+	Status        NotificationStatus `gorm:"type:varchar(20);not null;default:pending;index" json:"status"`
+	Attempts      int                `gorm:"default:0" json:"attempts"`
+	NextAttemptAt time.Time          `gorm:"not null;index" json:"next_attempt_at"`
+	LastError     string             `json:"last_error"`
+	DeliveredVia  string             `gorm:"type:varchar(20)" json:"delivered_via"`
+	SentAt        *time.Time         `json:"sent_at"`
+	CreatedAt     time.Time          `json:"created_at"`
+	UpdatedAt     time.Time          `json:"updated_at"`
+
+	// Relationships
+	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+// OAuthAuthorizationCode is a one-time OIDC authorization code awaiting exchange at the token endpoint
+type OAuthAuthorizationCode struct {
+	ID                  uint       `gorm:"primaryKey" json:"id"`
+	CodeHash            string     `gorm:"uniqueIndex;not null" json:"-"`
+	AppID               string     `gorm:"not null;type:text;index" json:"app_id"`
+	UserID              uint       `gorm:"not null;index" json:"user_id"`
+	RedirectURI         string     `gorm:"type:text;not null" json:"redirect_uri"`
+	Scope               string     `json:"scope"`
+	Nonce               string     `gorm:"type:text" json:"-"`
+	CodeChallenge       string     `json:"-"`
+	CodeChallengeMethod string     `gorm:"type:varchar(10)" json:"code_challenge_method"`
+	AuthTime            time.Time  `json:"auth_time"`
+	FamilyID            string     `json:"family_id"` // session family issued when the code was exchanged
+	ExpiresAt           time.Time  `gorm:"not null;index" json:"expires_at"`
+	UsedAt              *time.Time `json:"used_at"`
+	CreatedAt           time.Time  `json:"created_at"`
+}
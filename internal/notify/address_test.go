@@ -0,0 +1,66 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckPublicURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want error
+	}{
+		{"http://127.0.0.1/hook", ErrPrivateAddress},
+		{"http://localhost:8080/hook", ErrPrivateAddress},
+		{"http://10.0.0.5/hook", ErrPrivateAddress},
+		{"http://192.168.1.1/hook", ErrPrivateAddress},
+		{"http://169.254.169.254/latest/meta-data", ErrPrivateAddress},
+		{"http://100.64.0.1/hook", ErrPrivateAddress},
+		{"http://[::1]/hook", ErrPrivateAddress},
+		{"http://[fe80::1]/hook", ErrPrivateAddress},
+		{"http://0.0.0.0/hook", ErrPrivateAddress},
+		{"https://93.184.216.34/hook", nil},
+	}
+	for _, tt := range tests {
+		if err := CheckPublicURL(context.Background(), tt.url); !errors.Is(err, tt.want) {
+			t.Errorf("%s: error %v, want %v", tt.url, err, tt.want)
+		}
+	}
+
+	for _, raw := range []string{"ftp://example.com/", "http:///hook", "not a url"} {
+		if err := CheckPublicURL(context.Background(), raw); err == nil {
+			t.Errorf("%s: accepted", raw)
+		}
+	}
+}
+
+// A user webhook is refused at dial time even if it was saved before the check existed
+// or its name now resolves to an internal address
+func TestWebhookRefusesPrivateUserURL(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	w := NewWebhook("")
+	err := w.Send(context.Background(), Recipient{WebhookURL: server.URL}, Message{Title: "t", Body: "b"})
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Fatalf("error %v, want %v", err, ErrPrivateAddress)
+	}
+	if called {
+		t.Fatal("private webhook was called")
+	}
+
+	// The admin-configured default URL is trusted
+	w = NewWebhook(server.URL)
+	if err := w.Send(context.Background(), Recipient{}, Message{Title: "t", Body: "b"}); err != nil {
+		t.Fatalf("default webhook: %v", err)
+	}
+	if !called {
+		t.Fatal("default webhook was not called")
+	}
+}
@@ -0,0 +1,28 @@
+package notify
+
+import (
+	"context"
+	"log"
+)
+
+// Log writes messages to the server log instead of delivering them.
+// Useful for development; it is only used when a user selects it explicitly.
+type Log struct{}
+
+// NewLog creates a log-only notifier
+func NewLog() *Log {
+	return &Log{}
+}
+
+func (l *Log) Name() string {
+	return "log"
+}
+
+func (l *Log) Available(r Recipient) bool {
+	return true
+}
+
+func (l *Log) Send(ctx context.Context, r Recipient, msg Message) error {
+	log.Printf("[notify] to user %d (%s): %s - %s", r.UserID, r.Username, msg.Title, msg.Body)
+	return nil
+}
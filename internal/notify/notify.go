@@ -0,0 +1,130 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"tounetcore/internal/config"
+	"tounetcore/internal/models"
+)
+
+// ErrNoChannel is returned when a recipient has no usable notification channel
+var ErrNoChannel = errors.New("no notification channel available")
+
+// Message is a notification addressed to a single recipient
+type Message struct {
+	Title string
+	Body  string
+}
+
+// Recipient holds the destinations a user can be notified at
+type Recipient struct {
+	UserID        uint
+	Username      string
+	PushDeerToken string
+	Phone         string
+	Email         string
+	WebhookURL    string
+}
+
+// RecipientFromUser builds a recipient from a user's stored contact details
+func RecipientFromUser(user *models.User) Recipient {
+	return Recipient{
+		UserID:        user.ID,
+		Username:      user.Username,
+		PushDeerToken: user.PushDeerToken,
+		Phone:         user.Phone,
+		Email:         user.Email,
+		WebhookURL:    user.WebhookURL,
+	}
+}
+
+// Notifier delivers messages over one channel
+type Notifier interface {
+	// Name is the channel name users select, e.g. "pushdeer"
+	Name() string
+	// Available reports whether the recipient has a destination on this channel
+	Available(r Recipient) bool
+	Send(ctx context.Context, r Recipient, msg Message) error
+}
+
+// Channels lists the channel names a user may choose in an environment. "none" disables
+// notifications. "log" writes messages, NKeys included, to the server log, so it is
+// only offered in development.
+func Channels(environment string) []string {
+	channels := []string{"pushdeer", "email", "sms", "webhook"}
+	if environment == "development" {
+		channels = append(channels, "log")
+	}
+	return append(channels, "none")
+}
+
+// IsChannel reports whether name is a selectable channel in an environment
+func IsChannel(environment, name string) bool {
+	for _, channel := range Channels(environment) {
+		if channel == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fallbackOrder is the channel order tried when a user has no usable preference.
+// The log channel is never chosen implicitly.
+var fallbackOrder = []string{"pushdeer", "email", "sms", "webhook"}
+
+// Dispatcher routes messages to the notifier for a user's chosen channel
+type Dispatcher struct {
+	notifiers map[string]Notifier
+}
+
+// NewDispatcher creates a dispatcher with every backend enabled by the configuration
+func NewDispatcher(cfg *config.Config) *Dispatcher {
+	d := &Dispatcher{notifiers: make(map[string]Notifier)}
+	d.Register(NewPushDeer(cfg.PushDeerAPI))
+	d.Register(NewWebhook(cfg.NotifyWebhookURL))
+	d.Register(NewSMSWebhook(cfg.SMSWebhookURL))
+	if cfg.SMTPHost != "" {
+		d.Register(NewSMTP(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPFrom))
+	}
+	if cfg.Environment == "development" {
+		d.Register(NewLog())
+	}
+	return d
+}
+
+// Register adds or replaces a notifier
+func (d *Dispatcher) Register(n Notifier) {
+	d.notifiers[n.Name()] = n
+}
+
+// Resolve returns the notifier for the preferred channel, or the first channel in
+// fallback order the recipient can receive on. An explicit "none" disables delivery.
+func (d *Dispatcher) Resolve(preferred string, r Recipient) (Notifier, error) {
+	if preferred == "none" {
+		return nil, ErrNoChannel
+	}
+	if preferred != "" {
+		if n, ok := d.notifiers[preferred]; ok && n.Available(r) {
+			return n, nil
+		}
+	}
+	for _, name := range fallbackOrder {
+		if n, ok := d.notifiers[name]; ok && n.Available(r) {
+			return n, nil
+		}
+	}
+	return nil, ErrNoChannel
+}
+
+// Send delivers a message over the preferred channel or the first available fallback
+func (d *Dispatcher) Send(ctx context.Context, preferred string, r Recipient, msg Message) error {
+	n, err := d.Resolve(preferred, r)
+	if err != nil {
+		return err
+	}
+	if err := n.Send(ctx, r, msg); err != nil {
+		return fmt.Errorf("%s: %w", n.Name(), err)
+	}
+	return nil
+}
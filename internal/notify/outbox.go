@@ -0,0 +1,265 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+	"tounetcore/internal/config"
+	"tounetcore/internal/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// claimLease is how long a claimed notification is hidden from other workers.
+	// If a worker dies mid-delivery the row becomes due again after the lease.
+	claimLease = 2 * time.Minute
+	// maxRetryDelay caps the exponential backoff between attempts
+	maxRetryDelay = time.Hour
+	// sendTimeout bounds a single delivery attempt
+	sendTimeout = 30 * time.Second
+	// batchSize is the number of due notifications fetched per poll
+	batchSize = 50
+)
+
+// ErrNotRetryable is returned when retrying a notification that is not dead
+var ErrNotRetryable = errors.New("only dead notifications can be retried")
+
+// ErrSecretNotification is returned when retrying a notification whose NKey or reset code was discarded
+var ErrSecretNotification = errors.New("notifications carrying an NKey or reset code cannot be retried, issue a new one")
+
+// Enqueue writes a notification to the outbox. Pass the transaction of the event
+// that triggered it so the notification is only recorded if the event commits.
+func Enqueue(tx *gorm.DB, userID uint, event, channel string, msg Message) error {
+	notification := models.Notification{
+		UserID:        userID,
+		Event:         event,
+		Channel:       channel,
+		Title:         msg.Title,
+		Body:          msg.Body,
+		Status:        models.NotificationPending,
+		NextAttemptAt: time.Now(),
+	}
+	return tx.Create(&notification).Error
+}
+
+// Worker delivers pending outbox notifications in the background
+type Worker struct {
+	db           *gorm.DB
+	dispatcher   *Dispatcher
+	maxAttempts  int
+	retryBase    time.Duration
+	pollInterval time.Duration
+	drainTimeout time.Duration
+	done         chan struct{}
+}
+
+// NewWorker creates an outbox worker using the retry settings from the configuration
+func NewWorker(db *gorm.DB, dispatcher *Dispatcher, cfg *config.Config) *Worker {
+	return &Worker{
+		db:           db,
+		dispatcher:   dispatcher,
+		maxAttempts:  cfg.NotifyMaxAttempts,
+		retryBase:    cfg.NotifyRetryBase,
+		pollInterval: cfg.NotifyPollInterval,
+		drainTimeout: cfg.NotifyDrainTimeout,
+		done:         make(chan struct{}),
+	}
+}
+
+// Run delivers due notifications until ctx is cancelled. On cancellation it keeps
+// delivering whatever is already due for up to the drain timeout, then returns.
+func (w *Worker) Run(ctx context.Context) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Keep going without waiting while full batches are being processed
+		for w.processBatch(context.Background()) == batchSize {
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			w.drain()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Done is closed once Run has finished draining
+func (w *Worker) Done() <-chan struct{} {
+	return w.done
+}
+
+// drain delivers notifications that are already due, bounded by the drain timeout
+func (w *Worker) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), w.drainTimeout)
+	defer cancel()
+
+	for ctx.Err() == nil {
+		if w.processBatch(ctx) == 0 {
+			break
+		}
+	}
+
+	var pending int64
+	w.db.Model(&models.Notification{}).Where("status = ?", models.NotificationPending).Count(&pending)
+	if pending > 0 {
+		log.Printf("Notification worker stopped with %d pending notifications, they will be sent on next start", pending)
+	}
+}
+
+// processBatch delivers up to batchSize due notifications and returns how many it claimed
+func (w *Worker) processBatch(ctx context.Context) int {
+	var due []models.Notification
+	if err := w.db.Where("status = ? AND next_attempt_at <= ?", models.NotificationPending, time.Now()).
+		Order("next_attempt_at").Limit(batchSize).Find(&due).Error; err != nil {
+		log.Printf("Failed to load pending notifications: %v", err)
+		return 0
+	}
+
+	claimed := 0
+	for _, notification := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		if !w.claim(&notification) {
+			continue
+		}
+		claimed++
+		w.deliver(ctx, &notification)
+	}
+	return claimed
+}
+
+// claim takes ownership of a notification by bumping its attempt counter.
+// The conditional update fails if another worker claimed it first.
+func (w *Worker) claim(notification *models.Notification) bool {
+	result := w.db.Model(&models.Notification{}).
+		Where("id = ? AND status = ? AND attempts = ?", notification.ID, models.NotificationPending, notification.Attempts).
+		Updates(map[string]interface{}{
+			"attempts":        notification.Attempts + 1,
+			"next_attempt_at": time.Now().Add(claimLease),
+		})
+	if result.Error != nil || result.RowsAffected != 1 {
+		return false
+	}
+	notification.Attempts++
+	return true
+}
+
+// deliver sends a claimed notification and records the outcome
+func (w *Worker) deliver(ctx context.Context, notification *models.Notification) {
+	var user models.User
+	if err := w.db.First(&user, notification.UserID).Error; err != nil {
+		w.finish(notification, models.NotificationSkipped, "", "user not found")
+		return
+	}
+
+	recipient := RecipientFromUser(&user)
+	notifier, err := w.dispatcher.Resolve(notification.Channel, recipient)
+	if err != nil {
+		w.finish(notification, models.NotificationSkipped, "", err.Error())
+		return
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+
+	err = notifier.Send(sendCtx, recipient, Message{Title: notification.Title, Body: notification.Body})
+	if err == nil {
+		w.finish(notification, models.NotificationSent, notifier.Name(), "")
+		return
+	}
+
+	if notification.Attempts >= w.maxAttempts {
+		log.Printf("Notification %d dead after %d attempts: %v", notification.ID, notification.Attempts, err)
+		updates := map[string]interface{}{
+			"status":     models.NotificationDead,
+			"last_error": err.Error(),
+		}
+		if carriesSecret(notification.Event) {
+			updates["body"] = ""
+		}
+		w.db.Model(notification).Updates(updates)
+		return
+	}
+
+	w.db.Model(notification).Updates(map[string]interface{}{
+		"next_attempt_at": time.Now().Add(w.backoff(notification.Attempts)),
+		"last_error":      err.Error(),
+	})
+}
+
+// finish marks a notification as done and clears its body, which may hold secrets
+func (w *Worker) finish(notification *models.Notification, status models.NotificationStatus, via, reason string) {
+	updates := map[string]interface{}{
+		"status":        status,
+		"body":          "",
+		"delivered_via": via,
+		"last_error":    reason,
+	}
+	if status == models.NotificationSent {
+		updates["sent_at"] = time.Now()
+	}
+	w.db.Model(notification).Updates(updates)
+}
+
+// backoff returns the delay before the next attempt, doubling from the retry base
+func (w *Worker) backoff(attempts int) time.Duration {
+	delay := w.retryBase
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= maxRetryDelay {
+			return maxRetryDelay
+		}
+	}
+	return delay
+}
+
+// carriesSecret reports whether an event's body holds an NKey or reset code
+func carriesSecret(event string) bool {
+	for _, secret := range models.SecretNotificationEvents {
+		if event == secret {
+			return true
+		}
+	}
+	return false
+}
+
+// Retry puts a dead notification back in the queue with a fresh attempt budget.
+// Notifications that carried secrets lose their body when they die and are refused.
+func Retry(db *gorm.DB, id uint) error {
+	var notification models.Notification
+	if err := db.Select("id", "event", "status").First(&notification, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNotRetryable
+		}
+		return err
+	}
+	if notification.Status == models.NotificationDead && carriesSecret(notification.Event) {
+		return ErrSecretNotification
+	}
+
+	result := db.Model(&models.Notification{}).
+		Where("id = ? AND status = ?", id, models.NotificationDead).
+		Updates(map[string]interface{}{
+			"status":          models.NotificationPending,
+			"attempts":        0,
+			"next_attempt_at": time.Now(),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return ErrNotRetryable
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// PushDeer sends messages through the PushDeer push API
+type PushDeer struct {
+	API    string
+	Client *http.Client
+}
+
+// NewPushDeer creates a PushDeer notifier posting to the given API endpoint
+func NewPushDeer(api string) *PushDeer {
+	return &PushDeer{API: api, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *PushDeer) Name() string {
+	return "pushdeer"
+}
+
+func (p *PushDeer) Available(r Recipient) bool {
+	return p.API != "" && r.PushDeerToken != ""
+}
+
+// pushDeerResponse is the subset of the PushDeer API response we check
+type pushDeerResponse struct {
+	Code  int    `json:"code"`
+	Error string `json:"error"`
+}
+
+func (p *PushDeer) Send(ctx context.Context, r Recipient, msg Message) error {
+	form := url.Values{}
+	form.Set("pushkey", r.PushDeerToken)
+	form.Set("text", msg.Title)
+	form.Set("desp", msg.Body)
+	form.Set("type", "markdown")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.API, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("pushdeer returned status %d", resp.StatusCode)
+	}
+
+	// PushDeer reports failures with HTTP 200 and a non-zero code
+	var result pushDeerResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("invalid pushdeer response: %w", err)
+	}
+	if result.Code != 0 {
+		return fmt.Errorf("pushdeer error %d: %s", result.Code, result.Error)
+	}
+	return nil
+}
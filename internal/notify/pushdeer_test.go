@@ -0,0 +1,70 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPushDeerPostsMarkdownForm(t *testing.T) {
+	var form map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method %s, want POST", r.Method)
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parse form: %v", err)
+		}
+		form = map[string]string{}
+		for key := range r.PostForm {
+			form[key] = r.PostForm.Get(key)
+		}
+		w.Write([]byte(`{"code":0,"content":{"result":["ok"]}}`))
+	}))
+	defer server.Close()
+
+	p := NewPushDeer(server.URL)
+	r := Recipient{PushDeerToken: "PDU123"}
+	if err := p.Send(context.Background(), r, Message{Title: "Your NKey", Body: "**nk-abc**"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	want := map[string]string{"pushkey": "PDU123", "text": "Your NKey", "desp": "**nk-abc**", "type": "markdown"}
+	if len(form) != len(want) {
+		t.Fatalf("posted %v, want %v", form, want)
+	}
+	for key, value := range want {
+		if form[key] != value {
+			t.Fatalf("%s = %q, want %q", key, form[key], value)
+		}
+	}
+}
+
+func TestPushDeerReportsFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"http status", http.StatusBadGateway, `bad gateway`, "status 502"},
+		{"api code", http.StatusOK, `{"code":80501,"error":"invalid pushkey"}`, "invalid pushkey"},
+		{"invalid body", http.StatusOK, `<html>`, "invalid pushdeer response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			err := NewPushDeer(server.URL).Send(context.Background(), Recipient{PushDeerToken: "PDU123"}, Message{Title: "t", Body: "b"})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Webhook posts messages as JSON to the user's webhook URL, or a default URL
+type Webhook struct {
+	DefaultURL string
+	Client     *http.Client // for the configured default URL
+	UserClient *http.Client // for user-supplied URLs; only dials public addresses
+}
+
+// NewWebhook creates a webhook notifier with an optional default URL
+func NewWebhook(defaultURL string) *Webhook {
+	return &Webhook{
+		DefaultURL: defaultURL,
+		Client:     &http.Client{Timeout: 10 * time.Second},
+		UserClient: newPublicClient(10 * time.Second),
+	}
+}
+
+func (w *Webhook) Name() string {
+	return "webhook"
+}
+
+func (w *Webhook) Available(r Recipient) bool {
+	return w.target(r) != ""
+}
+
+func (w *Webhook) target(r Recipient) string {
+	if r.WebhookURL != "" {
+		return r.WebhookURL
+	}
+	return w.DefaultURL
+}
+
+func (w *Webhook) Send(ctx context.Context, r Recipient, msg Message) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"user_id":  r.UserID,
+		"username": r.Username,
+		"title":    msg.Title,
+		"body":     msg.Body,
+	})
+	if err != nil {
+		return err
+	}
+	if r.WebhookURL != "" {
+		return postJSON(ctx, w.UserClient, r.WebhookURL, payload)
+	}
+	return postJSON(ctx, w.Client, w.DefaultURL, payload)
+}
+
+// SMSWebhook posts messages to an SMS gateway as {"phone": ..., "message": ...}
+type SMSWebhook struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewSMSWebhook creates an SMS notifier backed by a gateway webhook
+func NewSMSWebhook(url string) *SMSWebhook {
+	return &SMSWebhook{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *SMSWebhook) Name() string {
+	return "sms"
+}
+
+func (s *SMSWebhook) Available(r Recipient) bool {
+	return s.URL != "" && r.Phone != ""
+}
+
+func (s *SMSWebhook) Send(ctx context.Context, r Recipient, msg Message) error {
+	text := msg.Title
+	if msg.Body != "" {
+		text += "\n" + msg.Body
+	}
+	payload, err := json.Marshal(map[string]string{
+		"phone":   r.Phone,
+		"message": text,
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.Client, s.URL, payload)
+}
+
+// postJSON posts a JSON payload and treats any non-2xx status as an error
+func postJSON(ctx context.Context, client *http.Client, url string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}